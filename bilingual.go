@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/biribiribiri/purepure/scn"
+)
+
+// controlCodeRE matches every control code that is dimmed in the bilingual
+// view.
+var controlCodeRE = regexp.MustCompile(strings.Join([]string{colorRE.String(), voiceRE.String(), widthRE.String(), `\\[Nn]`}, "|"))
+
+var bilingualTemplate = template.Must(template.New("bilingual").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.File}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; width: 100%; }
+td, th { border: 1px solid #ccc; padding: 4px; vertical-align: top; white-space: pre-wrap; }
+td.key { color: #888; font-size: small; white-space: nowrap; }
+.code { color: #bbb; }
+</style>
+</head>
+<body>
+<h1>{{.File}}</h1>
+<table>
+<tr><th>Key</th><th>Original</th><th>Translation</th></tr>
+{{range .Rows}}<tr><td class="key">{{.Key}}</td><td>{{.Original}}</td><td>{{.Translation}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type bilingualRow struct {
+	Key         string
+	Original    template.HTML
+	Translation template.HTML
+}
+
+// dimControlCodes returns s as HTML with its control codes dimmed.
+func dimControlCodes(s string) template.HTML {
+	var out strings.Builder
+	last := 0
+	for _, m := range controlCodeRE.FindAllStringIndex(s, -1) {
+		out.WriteString(template.HTMLEscapeString(s[last:m[0]]))
+		out.WriteString(`<span class="code">`)
+		out.WriteString(template.HTMLEscapeString(s[m[0]:m[1]]))
+		out.WriteString(`</span>`)
+		last = m[1]
+	}
+	out.WriteString(template.HTMLEscapeString(s[last:]))
+	return template.HTML(out.String())
+}
+
+// bilingual writes an HTML page per SCN file showing the original text next
+// to its translation, in the order the lines appear in the file.
+func bilingual() {
+	translations := make(map[string]string)
+	for _, l := range loadTLLines() {
+		translations[l.Key] = translation(l)
+	}
+
+	paths, err := globScn(*scnFileFlag)
+	Fatal(err)
+	for _, path := range paths {
+		data, err := readScn(path)
+		Fatal(err)
+		base := filepath.Base(path)
+		split, err := splitFile(base, data)
+		if err != nil {
+			log.Printf("WARNING: skipping %s: %v", base, err)
+			continue
+		}
+
+		var keys []string
+		originals := make(map[string]string)
+		for _, ss := range split {
+			if ss.Type == "" {
+				continue
+			}
+			key := scn.Key(base, ss.Type, ss.Index)
+			if v, ok := originals[key]; ok {
+				// Split lines are indicated with the split marker on its own line.
+				originals[key] = joinSplitLines(v, scn.Decode(ss.Data))
+				continue
+			}
+			keys = append(keys, key)
+			originals[key] = scn.Decode(ss.Data)
+		}
+
+		var rows []*bilingualRow
+		for _, key := range keys {
+			rows = append(rows, &bilingualRow{
+				Key:         key,
+				Original:    dimControlCodes(originals[key]),
+				Translation: dimControlCodes(translations[key]),
+			})
+		}
+
+		var out bytes.Buffer
+		Fatal(bilingualTemplate.Execute(&out, struct {
+			File string
+			Rows []*bilingualRow
+		}{base, rows}))
+		Fatal(writeFile(filepath.Join(*outputFolder, strings.TrimSuffix(base, filepath.Ext(base))+".html"), out.Bytes()))
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/biribiribiri/purepure/scn"
+)
+
+// csvLint checks the structure of every CSV in -translatedCsv, reporting
+// each problem with the row it is on, so that the sheet can be fixed before
+// a patch run fails on it.
+func csvLint() {
+	sources := translatedCsvSources()
+	numURLs := 0
+	for _, src := range sources {
+		if isURL(src) {
+			numURLs++
+		}
+	}
+	var problems []string
+	rows := 0
+	for _, src := range sources {
+		n, srcProblems := lintCsv(readCsvSource(src, csvCachePath(src, numURLs)))
+		rows += n
+		for _, p := range srcProblems {
+			problems = append(problems, src+": "+p)
+		}
+	}
+	for _, p := range problems {
+		log.Print("WARNING: ", p)
+	}
+	log.Printf("checked %d rows, found %d problems", rows, len(problems))
+	if len(problems) != 0 {
+		os.Exit(1)
+	}
+}
+
+// lintCsv returns the number of rows of a translated CSV, not counting the
+// header and comment rows, and the problems found in them. Rows are
+// numbered from 1, as in a spreadsheet.
+func lintCsv(data []byte) (int, []string) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	var problems []string
+	problem := func(row int, format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf("row %d: ", row)+fmt.Sprintf(format, v...))
+	}
+
+	// columns maps the name of each column to its position in the header.
+	var columns map[string]int
+	var header []string
+	keyRows := make(map[string]int)
+	rows := 0
+	for row := 1; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The rest of the file cannot be read reliably after a quoting
+			// error.
+			problem(row, "%v", err)
+			break
+		}
+		if len(record) != 0 {
+			record[0] = strings.TrimPrefix(record[0], "\ufeff")
+		}
+		if len(record) != 0 && strings.HasPrefix(record[0], "#") {
+			continue
+		}
+
+		if columns == nil {
+			header = record
+			columns = make(map[string]int)
+			for i, column := range header {
+				column = strings.TrimSpace(column)
+				if prev, ok := columns[column]; ok {
+					problem(row, "column %q is both column %d and %d", column, prev+1, i+1)
+					continue
+				}
+				columns[column] = i
+			}
+			for _, column := range requiredColumns {
+				if _, ok := columns[column]; !ok {
+					problem(row, "missing required column %q", column)
+				}
+			}
+			continue
+		}
+
+		rows++
+		if len(record) != len(header) {
+			problem(row, "has %d cells, but the header has %d columns", len(record), len(header))
+		}
+		cell := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		problems = append(problems, lintRow(row, cell, keyRows)...)
+	}
+	return rows, problems
+}
+
+// lintRow returns the problems of a row of a translated CSV that is not the
+// header. cell returns the text of a column of the row. keyRows records the
+// row of each key, to find rows with the same key.
+func lintRow(row int, cell func(column string) string, keyRows map[string]int) []string {
+	var problems []string
+	problem := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf("row %d: ", row)+fmt.Sprintf(format, v...))
+	}
+
+	key := cell("KEY")
+	if key == "" {
+		if cell("TRANSLATED_TEXT") != "" || cell("EDITTED_TEXT") != "" {
+			problem("has a translation but no KEY, so it is not patched")
+		}
+		return problems
+	}
+	if prev, ok := keyRows[key]; ok {
+		problem("KEY %q is also on row %d", key, prev)
+	} else {
+		keyRows[key] = row
+	}
+
+	base, _, keyIndex, keyErr := scn.ParseKey(key)
+	if keyErr != nil {
+		problem("%v", keyErr)
+	}
+	if filename := cell("FILENAME"); keyErr == nil && filename != "" && filename != base {
+		problem("FILENAME %q does not match KEY %q", filename, key)
+	}
+	if index, err := strconv.Atoi(strings.TrimSpace(cell("INDEX"))); err != nil {
+		problem("INDEX %q is not a number", cell("INDEX"))
+	} else if keyErr == nil && index != keyIndex {
+		problem("INDEX %d does not match KEY %q", index, key)
+	}
+	if s := cell("LENGTH"); s != "" {
+		length, err := strconv.Atoi(strings.TrimSpace(s))
+		switch {
+		case err != nil || length < 0:
+			problem("LENGTH %q is not a length", s)
+		case !*normalizeOriginal && cell("ORIGINAL_TEXT") != "" && cell("SPEAKER") == "":
+			// Normalized original text is not the text in the file, and the
+			// speaker may be translated, so their length cannot be checked.
+			if orig, err := scn.Encode(cell("ORIGINAL_TEXT")); err == nil && len(orig) != length {
+				problem("LENGTH is %d, but ORIGINAL_TEXT is %d bytes", length, len(orig))
+			}
+		}
+	}
+	for _, column := range []string{"TRANSLATED_TEXT", "EDITTED_TEXT"} {
+		for _, p := range lintSplitMarkers(cell(column)) {
+			problem("%s %s", column, p)
+		}
+	}
+	return problems
+}
+
+// lintSplitMarkers returns the problems with the split markers of a
+// translation: markers that do not split it because they are not on a line
+// of their own between two lines, lines that look like a marker but are not
+// exactly -splitMarker, and parts of a split translation that are empty.
+func lintSplitMarkers(tl string) []string {
+	if tl == "" {
+		return nil
+	}
+	var problems []string
+	markerRunes := func(r rune) bool {
+		return strings.ContainsRune(*splitMarker, r)
+	}
+	rest := removePPNewLines(splitMarkerRE.ReplaceAllString(tl, "\n"))
+	for _, line := range strings.Split(rest, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case line == *splitMarker:
+			problems = append(problems, fmt.Sprintf("has %q at its start or end, so it does not split the translation", *splitMarker))
+		case trimmed != "" && strings.TrimFunc(trimmed, markerRunes) == "":
+			problems = append(problems, fmt.Sprintf("has line %q, which looks like a malformed split marker %q", line, *splitMarker))
+		case strings.Contains(strings.ReplaceAll(line, `\`+*splitMarker, ""), *splitMarker):
+			problems = append(problems, fmt.Sprintf("has %q that is not on a line of its own, so it does not split the translation", *splitMarker))
+		}
+	}
+	if parts := splitMarkerRE.Split(tl, -1); len(parts) > 1 {
+		for i, part := range parts {
+			if strings.TrimSpace(removePPNewLines(part)) == "" {
+				problems = append(problems, fmt.Sprintf("part %d of %d is empty", i+1, len(parts)))
+			}
+		}
+	}
+	return problems
+}
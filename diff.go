@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/biribiribiri/purepure/scn"
+	"github.com/gocarina/gocsv"
+)
+
+var (
+	diffScnFiles = flag.String("diffScnFiles", "", "scn files to compare against -scnFiles in diff mode, e.g. the previous build")
+	diffCsv      = flag.Bool("diffCsv", false, "also write the differences found in diff mode to diff.csv in outputFolder")
+)
+
+// DiffLine is a difference between two builds of an SCN file found in diff
+// mode.
+type DiffLine struct {
+	Filename string `csv:"FILENAME"`
+	Key      string `csv:"KEY"`
+	Change   string `csv:"CHANGE"`
+	Old      string `csv:"OLD"`
+	New      string `csv:"NEW"`
+}
+
+func (d *DiffLine) String() string {
+	switch d.Change {
+	case "added":
+		return fmt.Sprintf("+ %s: %q", d.Key, d.New)
+	case "removed":
+		return fmt.Sprintf("- %s: %q", d.Key, d.Old)
+	case "changed":
+		return fmt.Sprintf("~ %s:\n  - %q\n  + %q", d.Key, d.Old, d.New)
+	default:
+		return fmt.Sprintf("! %s: %s: %s -> %s", d.Filename, d.Change, d.Old, d.New)
+	}
+}
+
+// segmentTexts returns the decoded text of the text, choice and file tag
+// segments of an SCN file keyed by scn.Key, along with the keys in file
+// order. Lines sharing an index are joined with the split marker.
+func segmentTexts(base string, split []*scn.Segment) (map[string]string, []string) {
+	texts := make(map[string]string)
+	var keys []string
+	for _, ss := range split {
+		if ss.Type == "" {
+			continue
+		}
+		key := scn.Key(base, ss.Type, ss.Index)
+		if v, ok := texts[key]; ok {
+			texts[key] = joinSplitLines(v, scn.Decode(ss.Data))
+			continue
+		}
+		texts[key] = scn.Decode(ss.Data)
+		keys = append(keys, key)
+	}
+	return texts, keys
+}
+
+// diffFile returns the differences between the old and new builds of base,
+// which must not be identical.
+func diffFile(base string, oldData, newData []byte) ([]*DiffLine, error) {
+	oldSplit, err := splitFile(base, oldData)
+	if err != nil {
+		return nil, fmt.Errorf("old file: %v", err)
+	}
+	newSplit, err := splitFile(base, newData)
+	if err != nil {
+		return nil, fmt.Errorf("new file: %v", err)
+	}
+
+	var diffs []*DiffLine
+	for _, st := range []scn.SegmentType{scn.TextSegment, scn.ChoiceSegment, scn.FileTagSegment} {
+		if before, after := countSegments(oldSplit, st), countSegments(newSplit, st); before != after {
+			diffs = append(diffs, &DiffLine{Filename: base, Change: fmt.Sprintf("%s segment count", st), Old: fmt.Sprint(before), New: fmt.Sprint(after)})
+		}
+	}
+
+	oldTexts, oldKeys := segmentTexts(base, oldSplit)
+	newTexts, newKeys := segmentTexts(base, newSplit)
+	for _, key := range oldKeys {
+		newText, ok := newTexts[key]
+		switch {
+		case !ok:
+			diffs = append(diffs, &DiffLine{Filename: base, Key: key, Change: "removed", Old: oldTexts[key]})
+		case newText != oldTexts[key]:
+			diffs = append(diffs, &DiffLine{Filename: base, Key: key, Change: "changed", Old: oldTexts[key], New: newText})
+		}
+	}
+	for _, key := range newKeys {
+		if _, ok := oldTexts[key]; !ok {
+			diffs = append(diffs, &DiffLine{Filename: base, Key: key, Change: "added", New: newTexts[key]})
+		}
+	}
+	if len(diffs) == 0 {
+		// Only the bytes between the segments changed.
+		diffs = append(diffs, &DiffLine{Filename: base, Change: "non-text bytes", Old: fmt.Sprintf("%d bytes", len(oldData)), New: fmt.Sprintf("%d bytes", len(newData))})
+	}
+	return diffs, nil
+}
+
+// diff compares the SCN files matching -diffScnFiles with the files of the
+// same name matching -scnFiles segment by segment, and prints the lines that
+// were added, removed or changed.
+func diff() {
+	if *diffScnFiles == "" {
+		Fatal(fmt.Errorf("diff mode requires -diffScnFiles"))
+	}
+	oldPaths, err := globScn(*diffScnFiles)
+	Fatal(err)
+	newPaths, err := globScn(*scnFileFlag)
+	Fatal(err)
+	oldByBase := make(map[string]string)
+	for _, path := range oldPaths {
+		oldByBase[filepath.Base(path)] = path
+	}
+	newByBase := make(map[string]string)
+	for _, path := range newPaths {
+		newByBase[filepath.Base(path)] = path
+	}
+	var bases []string
+	for base := range oldByBase {
+		bases = append(bases, base)
+	}
+	for base := range newByBase {
+		if _, ok := oldByBase[base]; !ok {
+			bases = append(bases, base)
+		}
+	}
+	sort.Strings(bases)
+
+	var all []*DiffLine
+	for _, base := range bases {
+		oldPath, newPath := oldByBase[base], newByBase[base]
+		var diffs []*DiffLine
+		switch {
+		case newPath == "":
+			diffs = []*DiffLine{{Filename: base, Change: "file", Old: oldPath, New: "missing"}}
+		case oldPath == "":
+			diffs = []*DiffLine{{Filename: base, Change: "file", Old: "missing", New: newPath}}
+		default:
+			oldData, err := readScn(oldPath)
+			Fatal(err)
+			newData, err := readScn(newPath)
+			Fatal(err)
+			if bytes.Equal(oldData, newData) {
+				continue
+			}
+			diffs, err = diffFile(base, oldData, newData)
+			if err != nil {
+				log.Printf("WARNING: skipping %s: %v", base, err)
+				continue
+			}
+		}
+		fmt.Printf("==== %s ====\n", base)
+		for _, d := range diffs {
+			fmt.Println(d)
+		}
+		fmt.Println()
+		all = append(all, diffs...)
+	}
+
+	if *diffCsv {
+		out, err := gocsv.MarshalBytes(all)
+		Fatal(err)
+		Fatal(writeFile(filepath.Join(*outputFolder, "diff.csv"), out))
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/biribiribiri/purepure/scn"
+)
+
+var (
+	dumpSegmentsFormat = flag.String("dumpSegmentsFormat", "text", "format of segment dumps; one of: text, json")
+	dumpFilter         = flag.String("dumpFilter", "", "only include segments of this type in segment dumps; one of: text, choice, filetag (default all segments)")
+	glueDistinct       = flag.Bool("glueDistinct", false, "in glue mode, print each distinct sequence of bytes between segments once across all files, most common first, instead of every sequence of each file")
+)
+
+// Filters of the segments dump, keys and extract include, for finding the
+// segments of interest without reading every dump.
+var (
+	filterType         = flag.String("filterType", "", "only dump and extract segments of this type; one of: text, choice, filetag")
+	filterFile         = flag.String("filterFile", "", "only dump and extract files whose name matches this glob, e.g. 4_*.scn")
+	filterTextContains = flag.String("filterTextContains", "", "only dump and extract segments whose decoded text contains this text")
+)
+
+// checkFilters exits if a filter flag is invalid.
+func checkFilters() {
+	switch scn.SegmentType(*filterType) {
+	case "", scn.TextSegment, scn.ChoiceSegment, scn.FileTagSegment:
+	default:
+		log.Fatalln("invalid filterType: ", *filterType)
+	}
+	if _, err := path.Match(*filterFile, ""); err != nil {
+		log.Fatalln("invalid filterFile: ", *filterFile)
+	}
+}
+
+// filtering returns true if any filter flag is set.
+func filtering() bool {
+	return *filterType != "" || *filterFile != "" || *filterTextContains != ""
+}
+
+// filterFileMatch returns true if the SCN file base matches -filterFile.
+func filterFileMatch(base string) bool {
+	match, _ := path.Match(*filterFile, base)
+	return *filterFile == "" || match
+}
+
+// filterText returns true if a segment of type st with the decoded text
+// passes -filterType and -filterTextContains. The bytes between segments
+// have neither, so they only pass if both are unset.
+func filterText(st scn.SegmentType, text string) bool {
+	if *filterType != "" && string(st) != *filterType {
+		return false
+	}
+	if *filterTextContains != "" && (st == "" || !strings.Contains(text, *filterTextContains)) {
+		return false
+	}
+	return true
+}
+
+// filterTLLines returns the lines of extract that pass the filters.
+func filterTLLines(lines []*TLLine) []*TLLine {
+	var out []*TLLine
+	for _, l := range lines {
+		_, st, _, err := scn.ParseKey(l.Key)
+		Fatal(err)
+		if filterFileMatch(l.Filename) && filterText(st, l.OriginalText) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// dumpSegment returns true if ss should be included in segment dumps.
+func dumpSegment(ss *scn.Segment) bool {
+	if *dumpFilter != "" && string(ss.Type) != *dumpFilter {
+		return false
+	}
+	if ss.Type == "" {
+		return filterText(ss.Type, "")
+	}
+	return filterText(ss.Type, scn.Decode(ss.Data))
+}
+
+// SegmentDump is the JSON representation of a scn.Segment produced by
+// dumpSegmentsJSON.
+type SegmentDump struct {
+	Offset    int             `json:"offset"`
+	HexOffset string          `json:"hexOffset"`
+	Type      scn.SegmentType `json:"type"`
+	LineIndex int             `json:"lineIndex"`
+	Text      string          `json:"text,omitempty"`
+	Hex       string          `json:"hex,omitempty"`
+	Length    int             `json:"length"`
+}
+
+// dumpSegmentsJSON returns the same information as dumpSegments in a form
+// that can be marshaled as JSON. Text segments are decoded, all other
+// segments are hex encoded.
+func dumpSegmentsJSON(segments []*scn.Segment) []*SegmentDump {
+	var out []*SegmentDump
+
+	offset := 0
+	for _, ss := range segments {
+		if !dumpSegment(ss) {
+			offset += len(ss.Data)
+			continue
+		}
+		sd := &SegmentDump{
+			Offset:    offset,
+			HexOffset: fmt.Sprintf("%x", offset),
+			Type:      ss.Type,
+			LineIndex: ss.Index,
+			Length:    len(ss.Data),
+		}
+		if ss.Type == scn.TextSegment {
+			sd.Text = scn.Decode(ss.Data)
+		} else {
+			sd.Hex = scn.HexEncode(ss.Data)
+		}
+		out = append(out, sd)
+		offset += len(ss.Data)
+	}
+
+	return out
+}
+
+// formatSegments dumps segments in the format selected by
+// -dumpSegmentsFormat.
+func formatSegments(segments []*scn.Segment) string {
+	switch *dumpSegmentsFormat {
+	case "text":
+		return dumpSegments(segments)
+	case "json":
+		out, err := json.MarshalIndent(dumpSegmentsJSON(segments), "", "  ")
+		Fatal(err)
+		return string(out)
+	default:
+		log.Fatalln("invalid dumpSegmentsFormat: ", *dumpSegmentsFormat)
+	}
+	return ""
+}
+
+// dumpGlue returns the untyped segments of an SCN file (the bytes between
+// text, choice and file tag segments) with their offsets.
+func dumpGlue(segments []*scn.Segment) string {
+	var out strings.Builder
+
+	offset := 0
+	for _, ss := range segments {
+		if ss.Type == "" {
+			out.WriteString(fmt.Sprintf("offset: %d (%x)\nlength: %d\ndata:\n%s\n", offset, offset, len(ss.Data), hex.Dump(ss.Data)))
+		}
+		offset += len(ss.Data)
+	}
+
+	return out.String()
+}
+
+// glueSequence returns the bytes between segments that segs[i] holds,
+// without the start marker of the segment after it, which would otherwise
+// make every sequence before a text line unique because of its index.
+func glueSequence(segs []*scn.Segment, i int) []byte {
+	data := segs[i].Data
+	if i+1 == len(segs) {
+		return data
+	}
+	switch segs[i+1].Type {
+	case scn.TextSegment:
+		return data[:len(data)-len(scn.LineStart(0))]
+	case scn.ChoiceSegment:
+		return data[:len(data)-len(scn.ChoiceStart())]
+	case scn.FileTagSegment:
+		return data[:len(data)-len(scn.FileTagStart())]
+	}
+	return data
+}
+
+// glueCount is a distinct sequence of bytes between segments found by
+// -glueDistinct.
+type glueCount struct {
+	data  []byte
+	count int
+	// first is the file and offset of the first occurrence.
+	first string
+}
+
+// dumpDistinctGlue returns every distinct sequence of bytes between the
+// segments of files, most common first, with the number of times it occurs
+// and where it first occurs.
+func dumpDistinctGlue(files map[string][]*scn.Segment) string {
+	var bases []string
+	for base := range files {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+
+	seen := make(map[string]*glueCount)
+	var counts []*glueCount
+	for _, base := range bases {
+		segs := files[base]
+		offset := 0
+		for i, ss := range segs {
+			if ss.Type == "" {
+				data := glueSequence(segs, i)
+				gc, ok := seen[string(data)]
+				if !ok {
+					gc = &glueCount{data: data, first: fmt.Sprintf("%s@%x", base, offset)}
+					seen[string(data)] = gc
+					counts = append(counts, gc)
+				}
+				gc.count++
+			}
+			offset += len(ss.Data)
+		}
+	}
+	sort.SliceStable(counts, func(i, j int) bool {
+		return counts[i].count > counts[j].count
+	})
+
+	var out strings.Builder
+	for _, gc := range counts {
+		out.WriteString(fmt.Sprintf("count: %d\nfirst: %s\nlength: %d\ndata:\n%s\n", gc.count, gc.first, len(gc.data), hex.Dump(gc.data)))
+	}
+	return out.String()
+}
+
+// glue prints the bytes between segments for every SCN file, for reverse
+// engineering the control codes stored there.
+func glue() {
+	paths, err := globScn(*scnFileFlag)
+	Fatal(err)
+	files := make(map[string][]*scn.Segment)
+	for _, path := range paths {
+		data, err := readScn(path)
+		Fatal(err)
+		base := filepath.Base(path)
+		split, err := splitFile(base, data)
+		if err != nil {
+			log.Printf("WARNING: skipping %s: %v", base, err)
+			continue
+		}
+		if *glueDistinct {
+			files[base] = split
+			continue
+		}
+		fmt.Printf("==== %s ====\n%s", base, dumpGlue(split))
+	}
+	if *glueDistinct {
+		fmt.Print(dumpDistinctGlue(files))
+	}
+}
+
+// dump prints the segments of every file matching -scnFiles in the
+// -dumpSegmentsFormat.
+func dump() {
+	switch scn.SegmentType(*dumpFilter) {
+	case "", scn.TextSegment, scn.ChoiceSegment, scn.FileTagSegment:
+	default:
+		log.Fatalln("invalid dumpFilter: ", *dumpFilter)
+	}
+	checkFilters()
+	paths, err := globScn(*scnFileFlag)
+	Fatal(err)
+	for _, path := range paths {
+		base := filepath.Base(path)
+		if !filterFileMatch(base) {
+			continue
+		}
+		data, err := readScn(path)
+		Fatal(err)
+		split, err := splitFile(base, data)
+		if err != nil {
+			log.Printf("WARNING: skipping %s: %v", base, err)
+			continue
+		}
+		fmt.Printf("==== %s ====\n%s\n", base, formatSegments(split))
+	}
+}
+
+// keys prints the key, segment type and original text of every line extract
+// writes for the files matching -scnFiles, to check the exact keys a
+// translation must use.
+func keys() {
+	checkFilters()
+	paths, err := globScn(*scnFileFlag)
+	Fatal(err)
+	for _, path := range paths {
+		data, err := readScn(path)
+		Fatal(err)
+		base := filepath.Base(path)
+		split, err := splitFile(base, data)
+		if err != nil {
+			log.Printf("WARNING: skipping %s: %v", base, err)
+			continue
+		}
+		for _, l := range filterTLLines(fileTLLines(base, split, nil)) {
+			_, st, _, err := scn.ParseKey(l.Key)
+			Fatal(err)
+			fmt.Printf("%s\t%s\t%q\n", l.Key, st, l.OriginalText)
+		}
+	}
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/biribiribiri/purepure/scn"
+	"github.com/gocarina/gocsv"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// setFlags sets the flags for the rest of the test, and sets up the state
+// derived from them like main does.
+func setFlags(t *testing.T, flags map[string]string) {
+	t.Helper()
+	// Cleanups run last first, so this runs after the flags are restored.
+	t.Cleanup(setup)
+	for name, value := range flags {
+		f := flag.Lookup(name)
+		if f == nil {
+			t.Fatalf("no flag %q", name)
+		}
+		old := f.Value.String()
+		if err := f.Value.Set(value); err != nil {
+			t.Fatalf("-%s=%s: %v", name, value, err)
+		}
+		t.Cleanup(func() { f.Value.Set(old) })
+	}
+	setup()
+}
+
+// useMemFS makes the modes read and write files in memory for the rest of
+// the test, starting with files.
+func useMemFS(t *testing.T, files map[string][]byte) *memFS {
+	t.Helper()
+	m := newMemFS(files)
+	old := fsys
+	fsys = m
+	t.Cleanup(func() { fsys = old })
+	return m
+}
+
+// golden compares got to the file name in testdata/e2e, or rewrites the file
+// with -update.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", "e2e", name)
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run the test with -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s does not match the golden file %s (run the test with -update to accept it):\ngot:\n%s\nwant:\n%s", name, path, got, want)
+	}
+}
+
+// readFile returns a file written by a mode.
+func readFile(t *testing.T, m *memFS, name string) []byte {
+	t.Helper()
+	data, err := m.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// scnBuilder builds a synthetic SCN file.
+type scnBuilder struct {
+	t    *testing.T
+	body []byte
+	// choices are the positions in body of the data of each file tag.
+	choices []int
+}
+
+func (b *scnBuilder) raw(data ...byte) *scnBuilder {
+	b.body = append(b.body, data...)
+	return b
+}
+
+func (b *scnBuilder) segment(start []byte, text string) *scnBuilder {
+	b.t.Helper()
+	data, err := scn.Encode(text)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	b.body = append(b.body, start...)
+	if bytes.Equal(start, scn.FileTagStart()) {
+		b.choices = append(b.choices, len(b.body))
+	}
+	b.body = append(append(b.body, data...), 0)
+	return b
+}
+
+func (b *scnBuilder) text(i uint32, text string) *scnBuilder {
+	return b.segment(scn.LineStart(i), text)
+}
+
+func (b *scnBuilder) choice(text, destination string) *scnBuilder {
+	return b.segment(scn.ChoiceStart(), text).segment(scn.FileTagStart(), destination)
+}
+
+// build returns the file, with a header holding the file size and one
+// choice record for each file tag.
+func (b *scnBuilder) build() []byte {
+	fileSizeOffset := 12 + 36*len(b.choices)
+	header := make([]byte, fileSizeOffset)
+	binary.LittleEndian.PutUint32(header, uint32(len(b.body)))
+	for i, pos := range b.choices {
+		binary.LittleEndian.PutUint32(header[12+36*i+32:], uint32(pos-len(scn.FileTagStart())))
+	}
+	return append(header, b.body...)
+}
+
+// e2eSCN returns the 1_1_1.scn fixture of the end-to-end test.
+func e2eSCN(t *testing.T) []byte {
+	b := &scnBuilder{t: t}
+	return b.raw(0xf0, 0x10).
+		text(0, "こんにちは").
+		text(1, `「太郎」元気？\V"v001"`).
+		raw(0xf0, 0x45, 0xf2, 1, 0, 0, 0, 0xf2, 2, 0, 0, 0, 0xf2, 3, 0, 0, 0, 0xf2, 4, 0, 0, 0).
+		choice("選択肢", "1_1_2.scn").
+		text(2, "さようなら").
+		raw(0xf0, 0x99).
+		build()
+}
+
+// TestExtractPatch runs extract and then patch over a synthetic SCN file,
+// and compares the extracted CSV and the patched file to the golden files in
+// testdata/e2e. The patched file is then extracted again to check that the
+// translations come back out of it.
+func TestExtractPatch(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "script", "1_1_1.scn")
+	translated, err := ioutil.ReadFile(filepath.Join("testdata", "e2e", "translated.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := useMemFS(t, map[string][]byte{
+		src:                          e2eSCN(t),
+		filepath.Join(dir, "tl.csv"): translated,
+	})
+	setFlags(t, map[string]string{
+		"scnFiles":        filepath.Join(dir, "script", "*.scn"),
+		"engScnFiles":     "",
+		"translatedCsv":   filepath.Join(dir, "tl.csv"),
+		"outputFolder":    filepath.Join(dir, "out"),
+		"outputScnFolder": filepath.Join(dir, "engspt"),
+		"wordwrap":        "30",
+		"quiet":           "true",
+	})
+
+	extract()
+	golden(t, "tllines.csv", readFile(t, m, filepath.Join(dir, "out", "tllines.csv")))
+
+	patch()
+	patched := readFile(t, m, filepath.Join(dir, "engspt", "1_1_1.scn"))
+	golden(t, "1_1_1.scn", patched)
+	fileSizeOffset := uint32(len(patched)) - scn.FileSizeHeader(patched)
+	if err := scn.CheckFileSizeHeader(patched, fileSizeOffset); err != nil {
+		t.Error(err)
+	}
+	if problems := checkChoiceOffsets("1_1_1.scn", patched); len(problems) != 0 {
+		t.Errorf("choice offsets of the patched file: %v", problems)
+	}
+
+	setFlags(t, map[string]string{"engScnFiles": filepath.Join(dir, "engspt", "*.scn")})
+	extract()
+	var lines []*TLLine
+	if err := gocsv.UnmarshalBytes(readFile(t, m, filepath.Join(dir, "out", "tllines.csv")), &lines); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, l := range lines {
+		got[l.Key] = strings.ReplaceAll(l.TranslatedText, "\n", " ")
+	}
+	for key, want := range map[string]string{
+		"1_1_1.scn-text-0":   "Hello there my dear friend how are you doing on this fine day",
+		"1_1_1.scn-text-1":   `「Taro」How are you?\V"v001"`,
+		"1_1_1.scn-choice-0": "Go home",
+		// Untranslated lines keep the original text.
+		"1_1_1.scn-text-2": "さようなら",
+	} {
+		if got[key] != want {
+			t.Errorf("%s: extracted %q from the patched file, want %q", key, got[key], want)
+		}
+	}
+}
+
+// TestPatchRouteChangeFiles patches a synthetic file with a route change
+// marker under the name of each of the default -routeChangeFiles, and checks
+// that the offset is moved by the bytes added before the line it points at,
+// and that files not in the list are left alone unless -routeChangeFiles is
+// "*".
+func TestPatchRouteChangeFiles(t *testing.T) {
+	b := &scnBuilder{t: t}
+	b.text(0, "あ").raw(0xf2, 0, 0, 0, 0)
+	offsetPos := len(b.body) - 4
+	b.segment(scn.FileTagStart(), "1_1_2.scn")
+	target := len(b.body)
+	binary.LittleEndian.PutUint32(b.body[offsetPos:], uint32(target))
+	b.text(1, "い")
+	data := b.build()
+
+	for _, tc := range []struct {
+		file string
+		// routeChangeFiles is the -routeChangeFiles, or empty for the
+		// default.
+		routeChangeFiles string
+		// want is the change to the route change offset. The first line
+		// grows by 3 bytes and is before the target, the second grows by 5
+		// and is not.
+		want int
+	}{
+		{"4_9_7.scn", "", 3},
+		{"4_10_2.scn", "", 3},
+		{"4_13_9.scn", "", 3},
+		{"5_10_1.scn", "", 3},
+		{"1_1_1.scn", "", 0},
+		{"1_1_1.scn", "*", 3},
+		{"4_9_7.scn", "1_1_1.scn", 0},
+	} {
+		t.Run(tc.file+"/"+tc.routeChangeFiles, func(t *testing.T) {
+			dir := t.TempDir()
+			base := strings.TrimSuffix(tc.file, ".scn")
+			csv := "KEY,INDEX,TRANSLATED_TEXT\n" + base + ".scn-text-0,0,Hello\n" + base + ".scn-text-1,1,Bye bye\n"
+			m := useMemFS(t, map[string][]byte{
+				filepath.Join(dir, "script", tc.file): data,
+				filepath.Join(dir, "tl.csv"):          []byte(csv),
+			})
+			flags := map[string]string{
+				"scnFiles":        filepath.Join(dir, "script", "*.scn"),
+				"translatedCsv":   filepath.Join(dir, "tl.csv"),
+				"outputFolder":    filepath.Join(dir, "out"),
+				"outputScnFolder": filepath.Join(dir, "engspt"),
+				"quiet":           "true",
+			}
+			if tc.routeChangeFiles != "" {
+				flags["routeChangeFiles"] = tc.routeChangeFiles
+			}
+			setFlags(t, flags)
+			patch()
+
+			patched := readFile(t, m, filepath.Join(dir, "engspt", tc.file))
+			i := bytes.Index(patched, scn.FileTagStart())
+			if i < 5 || patched[i-5] != 0xf2 {
+				t.Fatalf("no route change marker in the patched file % x", patched)
+			}
+			if got, want := binary.LittleEndian.Uint32(patched[i-4:]), uint32(target+tc.want); got != want {
+				t.Errorf("route change offset = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+// TestPatchLockedFile checks that a locked file without translations that
+// change it is written unchanged in both lock modes, although patch would
+// otherwise remove its speech bubbles.
+func TestPatchLockedFile(t *testing.T) {
+	for _, lockMode := range []string{"copy", "error"} {
+		t.Run(lockMode, func(t *testing.T) {
+			dir := t.TempDir()
+			data := e2eSCN(t)
+			m := useMemFS(t, map[string][]byte{
+				filepath.Join(dir, "script", "1_1_1.scn"): data,
+				filepath.Join(dir, "tl.csv"):              []byte("KEY,INDEX,TRANSLATED_TEXT\n1_1_1.scn-text-2,2,さようなら\n"),
+			})
+			setFlags(t, map[string]string{
+				"scnFiles":        filepath.Join(dir, "script", "*.scn"),
+				"translatedCsv":   filepath.Join(dir, "tl.csv"),
+				"outputFolder":    filepath.Join(dir, "out"),
+				"outputScnFolder": filepath.Join(dir, "engspt"),
+				"lockFiles":       "1_1_1.scn",
+				"lockMode":        lockMode,
+				"quiet":           "true",
+			})
+			patch()
+			if got := readFile(t, m, filepath.Join(dir, "engspt", "1_1_1.scn")); !bytes.Equal(got, data) {
+				t.Errorf("locked file was changed:\ngot  % x\nwant % x", got, data)
+			}
+		})
+	}
+}
+
+// TestPatchBlankChoice checks that a choice whose translation is empty once
+// translator notes and control codes are removed is reported in
+// warnings.csv, while an untranslated choice is not.
+func TestPatchBlankChoice(t *testing.T) {
+	for _, tc := range []struct {
+		name, tl string
+		warn     bool
+	}{
+		{"untranslated", "", false},
+		{"translated", "Go home", false},
+		{"translator note", "[[todo]]", true},
+		{"control codes", `\c12`, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			csv := "KEY,INDEX,TRANSLATED_TEXT\n1_1_1.scn-choice-0,0," + tc.tl + "\n"
+			m := useMemFS(t, map[string][]byte{
+				filepath.Join(dir, "script", "1_1_1.scn"): e2eSCN(t),
+				filepath.Join(dir, "tl.csv"):              []byte(csv),
+			})
+			setFlags(t, map[string]string{
+				"scnFiles":        filepath.Join(dir, "script", "*.scn"),
+				"translatedCsv":   filepath.Join(dir, "tl.csv"),
+				"outputFolder":    filepath.Join(dir, "out"),
+				"outputScnFolder": filepath.Join(dir, "engspt"),
+				"quiet":           "true",
+			})
+			patch()
+
+			var warnings []*scn.Warning
+			if err := gocsv.UnmarshalBytes(readFile(t, m, filepath.Join(dir, "out", "warnings.csv")), &warnings); err != nil {
+				t.Fatal(err)
+			}
+			warned := false
+			for _, w := range warnings {
+				if w.Key == "1_1_1.scn-choice-0" && strings.Contains(w.Reason, "empty") {
+					warned = true
+				}
+			}
+			if warned != tc.warn {
+				t.Errorf("empty choice warning = %v, want %v: %v", warned, tc.warn, warnings)
+			}
+		})
+	}
+}
+
+// TestRoundTrip checks which files come out of round-trip unchanged, which
+// patches the original text back in through the transforms of patch.
+func TestRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		data  func(t *testing.T) []byte
+		flags map[string]string
+		// ok is whether the file should round-trip.
+		ok bool
+	}{
+		{"e2e", e2eSCN, nil, true},
+		{"e2e with -speakerColumn", e2eSCN, map[string]string{"speakerColumn": "true"}, true},
+		{"split lines", func(t *testing.T) []byte {
+			b := &scnBuilder{t: t}
+			return b.text(0, "あ").text(0, "い").text(1, "う").build()
+		}, nil, true},
+		// The name brackets of the sheet are replaced with the ones the game
+		// uses.
+		{"replaced brackets", func(t *testing.T) []byte {
+			b := &scnBuilder{t: t}
+			return b.text(0, "【太郎】こんにちは").build()
+		}, nil, false},
+		{"brackets not replaced", func(t *testing.T) []byte {
+			b := &scnBuilder{t: t}
+			return b.text(0, "【太郎】こんにちは").build()
+		}, map[string]string{"bracketReplacements": ""}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "1_1_1.scn")
+			useMemFS(t, map[string][]byte{path: tc.data(t)})
+			setFlags(t, tc.flags)
+			if problems := roundTripProblems([]string{path}); (len(problems) == 0) != tc.ok {
+				t.Errorf("round trip problems: %q, want ok %v", problems, tc.ok)
+			}
+		})
+	}
+}
+
+// TestPatchStrictSizeVoiceTag checks that in strict size mode the voice tag
+// of the original is kept only if it fits, and that -markUntranslated markers
+// get no voice tag.
+func TestPatchStrictSizeVoiceTag(t *testing.T) {
+	// The original text-1 is 「太郎」元気？\V"v001", 22 bytes.
+	for _, tc := range []struct {
+		name, tl, want string
+		// warn is whether the voice tag is reported as not fitting.
+		warn bool
+	}{
+		{"tag fits", "Hi", `Hi\V"v001"` + strings.Repeat(" ", 12), false},
+		{"tag does not fit", "Sixteen bytes!!!", "Sixteen bytes!!!" + strings.Repeat(" ", 6), true},
+		{"untranslated", "", "[UT]" + strings.Repeat(" ", 18), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			csv := "KEY,INDEX,TRANSLATED_TEXT\n1_1_1.scn-text-1,1," + tc.tl + "\n"
+			m := useMemFS(t, map[string][]byte{
+				filepath.Join(dir, "script", "1_1_1.scn"): e2eSCN(t),
+				filepath.Join(dir, "tl.csv"):              []byte(csv),
+			})
+			setFlags(t, map[string]string{
+				"scnFiles":         filepath.Join(dir, "script", "*.scn"),
+				"translatedCsv":    filepath.Join(dir, "tl.csv"),
+				"outputFolder":     filepath.Join(dir, "out"),
+				"outputScnFolder":  filepath.Join(dir, "engspt"),
+				"strictSizeFiles":  "1_1_1.scn",
+				"markUntranslated": "[UT]",
+				"quiet":            "true",
+			})
+			patch()
+
+			segs, err := splitFile("1_1_1.scn", readFile(t, m, filepath.Join(dir, "engspt", "1_1_1.scn")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			for _, ss := range segs {
+				if ss.Type == scn.TextSegment && ss.Index == 1 {
+					got = scn.Decode(ss.Data)
+				}
+			}
+			if got != tc.want {
+				t.Errorf("text-1 = %q, want %q", got, tc.want)
+			}
+			var warnings []*scn.Warning
+			if err := gocsv.UnmarshalBytes(readFile(t, m, filepath.Join(dir, "out", "warnings.csv")), &warnings); err != nil {
+				t.Fatal(err)
+			}
+			warned := false
+			for _, w := range warnings {
+				if strings.Contains(w.Reason, "voice tag") {
+					warned = true
+				}
+			}
+			if warned != tc.warn {
+				t.Errorf("voice tag warning = %v, want %v: %v", warned, tc.warn, warnings)
+			}
+		})
+	}
+}
+
+// captureLog returns the log output of the rest of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+// TestMissingLineIndexWarning checks that a missing line index is reported
+// with the name of the file, and only once by patch.
+func TestMissingLineIndexWarning(t *testing.T) {
+	b := &scnBuilder{t: t}
+	data := b.text(0, "あ").text(2, "い").build()
+	for _, tc := range []struct {
+		mode string
+		run  func()
+	}{
+		{"extract", extract},
+		{"patch", patch},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			dir := t.TempDir()
+			useMemFS(t, map[string][]byte{
+				filepath.Join(dir, "script", "1_1_1.scn"): data,
+				filepath.Join(dir, "tl.csv"):              []byte("KEY,INDEX,TRANSLATED_TEXT\n1_1_1.scn-text-0,0,Hello\n"),
+			})
+			setFlags(t, map[string]string{
+				"scnFiles":         filepath.Join(dir, "script", "*.scn"),
+				"engScnFiles":      "",
+				"translatedCsv":    filepath.Join(dir, "tl.csv"),
+				"outputFolder":     filepath.Join(dir, "out"),
+				"outputScnFolder":  filepath.Join(dir, "engspt"),
+				"checkLineIndices": "true",
+				"quiet":            "true",
+			})
+			logs := captureLog(t)
+			tc.run()
+
+			var warnings []string
+			for _, line := range strings.Split(logs.String(), "\n") {
+				if strings.Contains(line, "missing") {
+					warnings = append(warnings, line)
+				}
+			}
+			if len(warnings) != 1 || !strings.Contains(warnings[0], "1_1_1.scn") {
+				t.Errorf("got missing line index warnings %q, want one that names 1_1_1.scn", warnings)
+			}
+		})
+	}
+}
+
+// TestValidateOffline checks that validate only round-trips the SCN files by
+// default, without reading the translated CSV or writing anything.
+func TestValidateOffline(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "script", "1_1_1.scn")
+	m := useMemFS(t, map[string][]byte{path: e2eSCN(t)})
+	setFlags(t, map[string]string{
+		"scnFiles":      filepath.Join(dir, "script", "*.scn"),
+		"translatedCsv": "https://example.com/missing.csv",
+		"csvCache":      filepath.Join(dir, "cache.csv"),
+		"offline":       "true",
+		"outputFolder":  filepath.Join(dir, "out"),
+	})
+	validate()
+	if len(m.files) != 1 {
+		t.Errorf("validate wrote files, now there are %d", len(m.files))
+	}
+}
+
+// TestReverseKeepsComments checks that reverse copies an edit of the English
+// file back into the sheet and keeps the comment rows of the translated CSV.
+func TestReverseKeepsComments(t *testing.T) {
+	dir := t.TempDir()
+	b := &scnBuilder{t: t}
+	orig := b.text(0, "こんにちは").text(1, "さようなら").build()
+	b = &scnBuilder{t: t}
+	eng := b.text(0, "Hi there").text(1, "Bye").build()
+	data := "KEY,INDEX,TRANSLATED_TEXT\n" +
+		"# section 1\n" +
+		"1_1_1.scn-text-0,0,Hello\n" +
+		"1_1_1.scn-text-1,1,Bye\n" +
+		"# end\n"
+	m := useMemFS(t, map[string][]byte{
+		filepath.Join(dir, "script", "1_1_1.scn"): orig,
+		filepath.Join(dir, "engspt", "1_1_1.scn"): eng,
+		filepath.Join(dir, "tl.csv"):              []byte(data),
+	})
+	setFlags(t, map[string]string{
+		"scnFiles":      filepath.Join(dir, "script", "*.scn"),
+		"engScnFiles":   filepath.Join(dir, "engspt", "*.scn"),
+		"translatedCsv": filepath.Join(dir, "tl.csv"),
+		"outputFolder":  filepath.Join(dir, "out"),
+		"quiet":         "true",
+	})
+	reverse()
+
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(readFile(t, m, filepath.Join(dir, "out", "tllines.csv")), []byte("\ufeff"))))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, record := range records[1:] {
+		if strings.HasPrefix(record[0], "#") {
+			got = append(got, record)
+		} else {
+			got = append(got, []string{record[1], record[4]})
+		}
+	}
+	want := [][]string{
+		{"# section 1"},
+		{"1_1_1.scn-text-0", "Hi there"},
+		{"1_1_1.scn-text-1", "Bye"},
+		{"# end"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tllines.csv = %q, want %q", got, want)
+	}
+}
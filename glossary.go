@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gocarina/gocsv"
+)
+
+var glossaryFile = flag.String("glossary", "", "csv file with TERM, REQUIRED and FORBIDDEN columns checked by validate; translations of lines whose original contains TERM must use REQUIRED, and no translation may use the | separated FORBIDDEN forms")
+
+// GlossaryTerm is a row of the -glossary CSV.
+type GlossaryTerm struct {
+	Term      string `csv:"TERM"`
+	Required  string `csv:"REQUIRED"`
+	Forbidden string `csv:"FORBIDDEN"`
+}
+
+// termRE returns a case insensitive regexp matching term as a whole word.
+func termRE(term string) *regexp.Regexp {
+	return regexp.MustCompile("(?i)" + wordExpr(term))
+}
+
+// wordExpr returns a regular expression matching term as a whole word.
+func wordExpr(term string) string {
+	expr := regexp.QuoteMeta(term)
+	isWord := func(r rune) bool {
+		return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))
+	}
+	if first, _ := utf8.DecodeRuneInString(term); isWord(first) {
+		expr = `\b` + expr
+	}
+	if last, _ := utf8.DecodeLastRuneInString(term); isWord(last) {
+		expr += `\b`
+	}
+	return expr
+}
+
+// checkGlossary reports translations that use a forbidden form of a term, or
+// do not use the required form of a term in their original text.
+func checkGlossary(tlLines []*TLLine, originals map[string]string) []string {
+	data, err := fsys.ReadFile(*glossaryFile)
+	Fatal(err)
+	var terms []*GlossaryTerm
+	Fatal(gocsv.UnmarshalBytes(data, &terms))
+
+	type forbidden struct {
+		form string
+		re   *regexp.Regexp
+	}
+	required := make([]*regexp.Regexp, len(terms))
+	forbiddenForms := make([][]forbidden, len(terms))
+	for i, t := range terms {
+		if t.Required != "" {
+			required[i] = termRE(t.Required)
+		}
+		for _, form := range strings.Split(t.Forbidden, "|") {
+			if form = strings.TrimSpace(form); form != "" {
+				forbiddenForms[i] = append(forbiddenForms[i], forbidden{form, termRE(form)})
+			}
+		}
+	}
+
+	var problems []string
+	for _, l := range tlLines {
+		if translation(l) == "" || l.Key == "" {
+			continue
+		}
+		// Match terms across wrapped lines and control codes.
+		tl := strings.Join(strings.Fields(stripControlCodes(removePPNewLines(translation(l)))), " ")
+		orig, ok := originals[l.Key]
+		if !ok {
+			orig = l.OriginalText
+		}
+		for i, t := range terms {
+			for _, f := range forbiddenForms[i] {
+				if f.re.MatchString(tl) {
+					problems = append(problems, fmt.Sprintf("%s: uses %q, %q should be translated as %q", l.Key, f.form, t.Term, t.Required))
+				}
+			}
+			if required[i] != nil && t.Term != "" && strings.Contains(orig, t.Term) && !required[i].MatchString(tl) {
+				problems = append(problems, fmt.Sprintf("%s: original has %q, but the translation does not use %q", l.Key, t.Term, t.Required))
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/gocarina/gocsv"
+)
+
+var (
+	verifyHashes = flag.String("verifyHashes", "", "csv file with FILENAME and SHA256 columns, as written by hash mode, that patch checks the SCN files against to make sure they are from the expected version of the game")
+	hashMismatch = flag.String("hashMismatch", "error", "how patch treats SCN files that do not match -verifyHashes; one of: error, warn")
+)
+
+// FileHash is a row of the -verifyHashes CSV.
+type FileHash struct {
+	Filename string `csv:"FILENAME"`
+	SHA256   string `csv:"SHA256"`
+}
+
+// sha256Hex returns the hex encoded SHA-256 hash of data.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadHashes returns the hash of each file in the -verifyHashes CSV, or nil
+// if it is not set.
+func loadHashes() map[string]string {
+	if *verifyHashes == "" {
+		return nil
+	}
+	switch *hashMismatch {
+	case "error", "warn":
+	default:
+		log.Fatalln("invalid hashMismatch: ", *hashMismatch)
+	}
+	data, err := fsys.ReadFile(*verifyHashes)
+	Fatal(err)
+	var rows []*FileHash
+	Fatal(gocsv.UnmarshalBytes(data, &rows))
+	hashes := make(map[string]string)
+	for _, row := range rows {
+		hashes[row.Filename] = strings.ToLower(strings.TrimSpace(row.SHA256))
+	}
+	return hashes
+}
+
+// hash writes the SHA-256 hash of every file matching -scnFiles to
+// hashes.csv in the -outputFolder, for use with -verifyHashes.
+func hash() {
+	paths, err := globScn(*scnFileFlag)
+	Fatal(err)
+	var rows []*FileHash
+	for _, path := range paths {
+		data, err := readScn(path)
+		Fatal(err)
+		rows = append(rows, &FileHash{Filename: filepath.Base(path), SHA256: sha256Hex(data)})
+	}
+	out, err := gocsv.MarshalBytes(rows)
+	Fatal(err)
+	Fatal(writeFile(filepath.Join(*outputFolder, "hashes.csv"), out))
+	log.Printf("wrote the hashes of %d files", len(rows))
+}
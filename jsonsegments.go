@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/biribiribiri/purepure/scn"
+)
+
+var (
+	outputFormat     = flag.String("outputFormat", "csv", "extract output format; one of: csv, json (tllines.json), json-segments (one lossless JSON file per SCN file)")
+	inputFormat      = flag.String("inputFormat", "csv", "patch input format; one of: csv, json-segments")
+	jsonSegmentFiles = flag.String("jsonSegmentFiles", "*.json", "json-segments files to patch from")
+)
+
+// JSONFile is the lossless JSON representation of an SCN file used by the
+// json-segments format.
+type JSONFile struct {
+	File         string         `json:"file"`
+	OriginalSize int            `json:"originalSize"`
+	Segments     []*JSONSegment `json:"segments"`
+}
+
+// JSONSegment is a segment of a JSONFile. Text, choice and file tag segments
+// whose bytes survive a -encoding round trip are stored as Text; everything
+// else is stored as hex.
+type JSONSegment struct {
+	Type  scn.SegmentType `json:"type,omitempty"`
+	Index int             `json:"index"`
+	Text  *string         `json:"text,omitempty"`
+	Hex   string          `json:"hex,omitempty"`
+	// Length is the length of the segment in the original file, used to
+	// move the route change offsets by the bytes changed before them.
+	Length int `json:"length"`
+}
+
+// toJSONFile converts the segments of an SCN file to a JSONFile.
+func toJSONFile(base string, data []byte, segs []*scn.Segment) *JSONFile {
+	jf := &JSONFile{File: base, OriginalSize: len(data)}
+	for _, ss := range segs {
+		js := &JSONSegment{Type: ss.Type, Index: ss.Index, Length: len(ss.Data)}
+		if ss.Type != "" {
+			text := scn.Decode(ss.Data)
+			if enc, err := scn.Encode(text); err == nil && bytes.Equal(enc, ss.Data) {
+				js.Text = &text
+			}
+		}
+		if js.Text == nil {
+			js.Hex = scn.HexEncode(ss.Data)
+		}
+		jf.Segments = append(jf.Segments, js)
+	}
+	return jf
+}
+
+// fromJSONFile converts a JSONFile back to segments.
+func fromJSONFile(jf *JSONFile) ([]*scn.Segment, error) {
+	var segs []*scn.Segment
+	for i, js := range jf.Segments {
+		ss := &scn.Segment{Type: js.Type, Index: js.Index}
+		if js.Text != nil {
+			data, err := scn.Encode(*js.Text)
+			if err != nil {
+				return nil, fmt.Errorf("segment %d: %v", i, err)
+			}
+			ss.Data = data
+		} else {
+			data, err := hex.DecodeString(strings.ReplaceAll(js.Hex, " ", ""))
+			if err != nil {
+				return nil, fmt.Errorf("segment %d: %v", i, err)
+			}
+			ss.Data = data
+		}
+		segs = append(segs, ss)
+	}
+	return segs, nil
+}
+
+// writeJSONSegments writes a json-segments file for every SCN file.
+func writeJSONSegments() {
+	paths, err := globScn(*scnFileFlag)
+	Fatal(err)
+	for _, path := range paths {
+		data, err := readScn(path)
+		Fatal(err)
+		base := filepath.Base(path)
+		split, err := splitFile(base, data)
+		if err != nil {
+			log.Printf("WARNING: skipping %s: %v", base, err)
+			continue
+		}
+		out, err := json.MarshalIndent(toJSONFile(base, data, split), "", "  ")
+		Fatal(err)
+		Fatal(writeFile(filepath.Join(*outputFolder, strings.TrimSuffix(base, filepath.Ext(base))+".json"), out))
+	}
+}
+
+// patchJSONSegments rebuilds SCN files from json-segments files, fixing the
+// file size header and choice and route change offsets.
+func patchJSONSegments() {
+	baseToReferencePath := referencePaths()
+	patcher := &scn.Patcher{RouteChangeFiles: splitList(*routeChangeFlag), Debugf: logV}
+	paths, err := fsys.Glob(*jsonSegmentFiles)
+	Fatal(err)
+	for _, path := range paths {
+		data, err := fsys.ReadFile(path)
+		Fatal(err)
+		var jf JSONFile
+		if err := json.Unmarshal(data, &jf); err != nil {
+			log.Printf("WARNING: skipping %s: %v", path, err)
+			continue
+		}
+		segs, err := fromJSONFile(&jf)
+		if err != nil {
+			log.Printf("WARNING: skipping %s: %v", path, err)
+			continue
+		}
+		outData := scn.CombineSegments(segs)
+		if len(outData) < 4 {
+			log.Printf("WARNING: skipping %s: file is too short to have a header", path)
+			continue
+		}
+		fileSizeOffset := uint32(jf.OriginalSize) - scn.FileSizeHeader(outData)
+		if err := scn.FixFileSizeHeader(outData, fileSizeOffset, segs); err != nil {
+			log.Printf("WARNING: %v %v", jf.File, err)
+		}
+		var origLengths []int
+		total := 0
+		for _, js := range jf.Segments {
+			origLengths = append(origLengths, js.Length)
+			total += js.Length
+		}
+		if total == jf.OriginalSize {
+			outData = patcher.FixRouteChangeSegments(jf.File, outData, fileSizeOffset, segs, origLengths)
+		} else {
+			// Files written before the segment lengths were recorded can only
+			// be moved by the change to the size of the whole file.
+			logV("%s: segment lengths do not add up to the original size, moving route change offsets by the change in file size", path)
+			outData = patcher.FixRouteChange(jf.File, outData, len(outData)-jf.OriginalSize)
+		}
+		if err := scn.CheckFileSizeHeader(outData, fileSizeOffset); err != nil {
+			log.Printf("WARNING: %v %v", jf.File, err)
+		}
+		writePatched(jf.File, outData, baseToReferencePath)
+	}
+}
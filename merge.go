@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gocarina/gocsv"
+)
+
+var mergeInto = flag.String("mergeInto", "", "existing csv to merge extracted lines into; its columns, column order and translations are kept, only the columns read from the SCN files are refreshed")
+
+// refreshedColumns are the columns of the existing CSV that extract
+// overwrites when merging. The other columns are only filled in if empty.
+var refreshedColumns = map[string]bool{
+	"FILENAME":      true,
+	"KEY":           true,
+	"INDEX":         true,
+	"LENGTH":        true,
+	"DESTINATION":   true,
+	"ORIGINAL_TEXT": true,
+}
+
+// contextColumns are refreshed like refreshedColumns when -withContext is
+// set. Otherwise the extracted lines have no context, and the context
+// already in the CSV is kept.
+var contextColumns = map[string]bool{
+	"PREV_TEXT": true,
+	"NEXT_TEXT": true,
+}
+
+// readCsvRecords returns the header and rows of a CSV file, with any byte
+// order mark and comment rows removed.
+func readCsvRecords(path string) ([]string, [][]string, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, _, _, err = stripCommentRows(bytes.TrimPrefix(data, []byte("\ufeff")))
+	if err != nil {
+		return nil, nil, err
+	}
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("%s is empty", path)
+	}
+	header := records[0]
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	return header, records[1:], nil
+}
+
+// mergeTLLines returns lines merged into the existing CSV at path. Rows are
+// matched by key, in order for split lines that share a key. Rows whose key
+// is no longer extracted are kept at the end so that no translation is lost.
+// Translated rows whose original text changed are marked needsReviewStatus,
+// and the old original text is added to their notes.
+func mergeTLLines(path string, lines []*TLLine) ([]byte, error) {
+	header, rows, err := readCsvRecords(path)
+	if err != nil {
+		return nil, err
+	}
+	newData, err := gocsv.MarshalBytes(lines)
+	if err != nil {
+		return nil, err
+	}
+	newRecords, err := csv.NewReader(bytes.NewReader(newData)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	newHeader, newRows := newRecords[0], newRecords[1:]
+
+	column := make(map[string]int)
+	for i, name := range header {
+		column[name] = i
+	}
+	keyColumn, ok := column["KEY"]
+	if !ok {
+		return nil, fmt.Errorf("%s has no KEY column", path)
+	}
+	_, hadOriginals := column["ORIGINAL_TEXT"]
+	for _, name := range []string{"LINE_STATUS", "NOTES"} {
+		if _, ok := column[name]; !ok {
+			column[name] = len(header)
+			header = append(header, name)
+		}
+	}
+	for _, name := range newHeader {
+		if _, ok := column[name]; !ok {
+			column[name] = len(header)
+			header = append(header, name)
+		}
+	}
+	newKeyColumn := 0
+	for i, name := range newHeader {
+		if name == "KEY" {
+			newKeyColumn = i
+		}
+	}
+
+	// existing maps each key to its rows, in file order.
+	existing := make(map[string][][]string)
+	var order []string
+	for _, row := range rows {
+		for len(row) < len(header) {
+			row = append(row, "")
+		}
+		key := row[keyColumn]
+		if _, ok := existing[key]; !ok {
+			order = append(order, key)
+		}
+		existing[key] = append(existing[key], row)
+	}
+
+	out := [][]string{header}
+	changed := 0
+	for i, newRow := range newRows {
+		key := newRow[newKeyColumn]
+		row := make([]string, len(header))
+		if old := existing[key]; len(old) != 0 {
+			row = old[0]
+			existing[key] = old[1:]
+		}
+		oldOriginal := row[column["ORIGINAL_TEXT"]]
+		translated := row[column["TRANSLATED_TEXT"]] != "" || row[column["EDITTED_TEXT"]] != ""
+		for i, name := range newHeader {
+			if refreshedColumns[name] || *withContext && contextColumns[name] || row[column[name]] == "" {
+				row[column[name]] = newRow[i]
+			}
+		}
+		// -speakerColumn moves the speaker out of the original text, which does
+		// not change the line.
+		if hadOriginals && translated && oldOriginal != "" && oldOriginal != row[column["ORIGINAL_TEXT"]] && oldOriginal != lines[i].Speaker+lines[i].OriginalText {
+			row[column["LINE_STATUS"]] = needsReviewStatus
+			note := fmt.Sprintf("original was: %s", oldOriginal)
+			if notes := row[column["NOTES"]]; notes != "" {
+				note = notes + "\n" + note
+			}
+			row[column["NOTES"]] = note
+			changed++
+		}
+		out = append(out, row)
+	}
+	if changed != 0 {
+		log.Printf("WARNING: marked %d rows %s because their original text changed", changed, needsReviewStatus)
+	}
+	stale := 0
+	for _, key := range order {
+		for _, row := range existing[key] {
+			out = append(out, row)
+			stale++
+		}
+	}
+	if stale != 0 {
+		log.Printf("WARNING: kept %d rows of %s whose key is no longer in the SCN files", stale, path)
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.WriteAll(out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
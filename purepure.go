@@ -3,39 +3,97 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
+	"crypto/sha1"
+	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
+	"github.com/biribiribiri/purepure/scn"
 	"github.com/gocarina/gocsv"
+	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/unicode/norm"
 )
 
 var (
-	scnFileFlag       = flag.String("scnFiles", filepath.Join(ExePath(), "script/*.scn"), "scn files")
+	scnFileFlag       = flag.String("scnFiles", filepath.Join(ExePath(), "script/*.scn"), "scn files; a zip archive, or a glob in one such as scripts.zip!script/*.scn, reads the files from the archive")
 	engScnFileFlag    = flag.String("engScnFiles", filepath.Join(ExePath(), "engspt/*.scn"), "scn files")
 	referenceScnFiles = flag.String("referenceScnFiles", filepath.Join(ExePath(), "reference/*.scn"), "reference folder (for testing only)")
 
 	referenceCheck = flag.Bool("referenceCheck", false, "check the output against the reference files")
 	outputFolder   = flag.String("outputFolder", "", "output folder")
-	modeFlag       = flag.String("mode", "patch", "one of: extract, patch")
+	modeFlag       = flag.String("mode", "patch", "one of: extract, patch, unsafe-glyphs, glue, length-ratio, bilingual, validate, encode-table, preview-diff, sheet, unchanged-eng, choice-offsets, tmx, corpus, diff, dump, stats, roundtrip, verify-encoding, keys, reverse, hash, csvlint")
 	translatedCsv  = flag.String("translatedCsv",
-		"https://docs.google.com/spreadsheets/d/13U9Yqr98QzYlLjsiJpKAzUPWJY9zGpPKg24KZqzgjPU/export?format=csv&id=13U9Yqr98QzYlLjsiJpKAzUPWJY9zGpPKg24KZqzgjPU", "path to translated csv")
-	outputScnFolder = flag.String("outputScnFolder", filepath.Join(ExePath(), "engspt"), "output folder")
-	wordWrapLength  = flag.Int("wordwrap", 50, "word wrap length (in characters)")
-	verbose         = flag.Bool("verbose", false, "verbose logging")
-
-	jisDecoder = japanese.ShiftJIS.NewDecoder()
-	jisEncoder = japanese.ShiftJIS.NewEncoder()
+		"https://docs.google.com/spreadsheets/d/13U9Yqr98QzYlLjsiJpKAzUPWJY9zGpPKg24KZqzgjPU/export?format=csv&id=13U9Yqr98QzYlLjsiJpKAzUPWJY9zGpPKg24KZqzgjPU", "path to translated csv; a comma separated list of paths, globs and URLs merges several csvs")
+	outputScnFolder     = flag.String("outputScnFolder", filepath.Join(ExePath(), "engspt"), "output folder")
+	wordWrapLength      = flag.Int("wordwrap", 50, "word wrap length (in characters); a \\w<N> in a translation, such as \\w30, sets the length for the rest of that translation and is removed before patching")
+	verbose             = flag.Bool("verbose", false, "verbose logging")
+	quiet               = flag.Bool("quiet", false, "do not show the progress of extract and patch")
+	lockFilesFlag       = flag.String("lockFiles", "", "comma separated list of files that must not be changed by patch")
+	allowLossyParse     = flag.Bool("allowLossyParse", false, "warn instead of failing when a parsed SCN file does not combine back into the original bytes")
+	sortByStatus        = flag.Bool("sortByStatus", false, "sort the extracted lines so that untranslated lines come first, then fuzzy lines, then translated lines")
+	maxChoiceWidth      = flag.Int("maxChoiceWidth", 0, "maximum display width of a translated choice (0 for no limit)")
+	markUntranslated    = flag.String("markUntranslated", "", "text that patch replaces untranslated lines and choices with, e.g. [UNTRANSLATED], so that playtesters can see them; in strict size mode it is cut to the original length")
+	maxLines            = flag.Int("maxLines", 0, "maximum number of lines a wrapped translation may have in a text box, counting each page and split line separately (0 for no limit)")
+	wrapStrict          = flag.Bool("wrapStrict", false, "fail instead of warning when a translation is wider than allowed")
+	keepBubbles         = flag.Bool("keepBubbles", false, "do not remove speech bubbles from any file")
+	keepBubblesFlag     = flag.String("keepBubblesFiles", "", "comma separated list of files to not remove speech bubbles from")
+	segmentCapBytes     = flag.Int("segmentCapBytes", -1, "warn when a translated line is more than this many bytes longer than the original line (-1 to disable)")
+	commentStart        = flag.String("commentStart", "[[", "start of translator notes that patch removes from translations; empty to keep everything")
+	commentEnd          = flag.String("commentEnd", "]]", "end of translator notes that patch removes from translations")
+	splitMarker         = flag.String("splitMarker", "~~~~", "marker written on its own line between the lines of a translation that share an index")
+	failOnDuplicateKeys = flag.Bool("failOnDuplicateKeys", false, "abort patching if the translated csv has more than one translated row with the same key")
+	atomic              = flag.Bool("atomic", false, "only write patched files if every file patches and validates without problems")
+	terminatorFlag      = flag.Uint("lineTerminator", 0, "byte that terminates each line in the SCN files (e.g. 0x00)")
+	linkChoices         = flag.Bool("linkChoices", false, "fill in the destination file of each choice when extracting")
+	checkColorsFlag     = flag.Bool("checkColors", false, "warn when a patched line leaves a color open at the end of a wrapped line")
+	singleFile          = flag.String("file", "", "extract only this SCN file, given as a path or as the name of a file matching -scnFiles, to <name>.csv and print its segments")
+	csvBOM              = flag.Bool("csvBOM", false, "start extracted CSVs with a UTF-8 byte order mark so that Excel opens them as UTF-8")
+	splitOutput         = flag.Bool("splitOutput", false, "extract to one CSV per SCN file instead of a single tllines.csv")
+	normalizeSpacesFlag = flag.Bool("normalizeSpaces", false, "collapse runs of spaces in translations into a single space")
+	keepIndentation     = flag.Bool("keepIndentation", false, "keep leading spaces on each line when normalizing spaces")
+	dryRun              = flag.Bool("dryRun", false, "in patch, write no files, and instead print the original and patched text of every line that would be replaced, grouped by file")
+	speakerColumn       = flag.Bool("speakerColumn", false, "in extract, move the speaker name in 「」 or 【】 at the start of a text line to the SPEAKER column; patch puts the SPEAKER back in front of the translation")
+	withContext         = flag.Bool("withContext", false, "in extract, fill the PREV_TEXT and NEXT_TEXT columns of each line with the original text of the text lines before and after it in the file")
+	dedupeOutput        = flag.Bool("dedupeOutput", true, "do not rewrite patched files whose contents did not change, so only the files whose translations changed are written")
+	emptyChoiceError    = flag.Bool("emptyChoiceError", false, "fail instead of warning when a choice is translated as empty text")
+	checkLineIndices    = flag.Bool("checkLineIndices", false, "warn when the line start of a text line index is missing from an SCN file, so that the lines after it are not found")
+	normalizeOriginal   = flag.Bool("normalizeOriginal", false, "convert half-width katakana in the extracted ORIGINAL_TEXT to full-width; the SCN files are not changed, but roundtrip cannot check CSVs extracted with it")
+	lockMode            = flag.String("lockMode", "copy", "how patch treats locked files; one of: copy (write the original file unchanged), error (fail if a translation would change the file)")
+	encodingFlag        = flag.String("encoding", "shiftjis", "text encoding of the scn files; one of: shiftjis, eucjp, utf8")
+	bracketsFlag        = flag.String("bracketReplacements", "【=「,】=」", "comma separated FROM=TO replacements made in translations, by default the name brackets of the sheet with the ones the game uses; empty to disable")
+	keepBracketsFlag    = flag.String("keepBracketsFiles", "", "comma separated list of files whose translations are left out of -bracketReplacements")
+	substitutionsFile   = flag.String("substitutions", "", "csv file with FROM and TO columns of text to replace in translations before encoding, e.g. curly quotes with straight quotes")
+	abbreviationsFile   = flag.String("abbreviations", "", "csv file with FROM and TO columns of abbreviations of whole words, e.g. and to &, applied to translations that are too long for strict size mode before they are skipped")
+	wrapMeasure         = flag.String("wrapMeasure", "width", "how line length is measured for word wrapping; one of: width (full-width characters count as two columns), bytes (UTF-8 bytes, or characters in char wrap mode, as in older builds)")
+	pageBreak           = flag.String("pageBreak", "", "control code written in translations where the game waits for a click and starts a new page, such as \\p; the text on each side of it is wrapped separately. The game's page break code has not been identified, so it is empty by default, which wraps page breaks as ordinary text")
+	wrapMode            = flag.String("wrapMode", "space", "how translations are word wrapped; one of: space (break between words), char (break anywhere, for text without spaces)")
+	wrapOverridesFile   = flag.String("wrapOverrides", "", "csv file with FILENAME, SEGMENT_TYPE and WORDWRAP columns that override -wordwrap; SEGMENT_TYPE may be empty to match every segment, and FILENAME may be * to match every file; choices and file tags are never wrapped")
+	strictSizeFlag      = flag.String("strictSizeFiles", "2_6_6.scn,4_12_1.scn", "comma separated list of files whose lines must keep their original byte length")
+	strictSizePadding   = flag.String("strictSizePadding", " ", "text repeated to pad short translations to their original byte length in strict size mode, or hex bytes such as 0x8140")
+	routeChangeFlag     = flag.String("routeChangeFiles", "4_9_7.scn,4_10_2.scn,4_13_9.scn,5_10_1.scn", "comma separated list of files whose route change offsets are updated by patch, or * for every file with route change markers")
+	workersFlag         = flag.Int("workers", runtime.NumCPU(), "number of files extract and patch process at the same time")
+	csvCache            = flag.String("csvCache", "", "file to cache the downloaded translated csv in; it is only downloaded again if the sheet changed")
+	offline             = flag.Bool("offline", false, "use the -csvCache file instead of downloading the translated csv")
+	downloadRetries     = flag.Int("downloadRetries", 3, "number of times to retry a failed download of the translated csv")
+	downloadRetryDelay  = flag.Duration("downloadRetryDelay", time.Second, "delay before the first retry of a failed download; it doubles after every retry")
 )
 
 func ExePath() string {
@@ -51,36 +109,47 @@ func Fatal(err error) {
 	}
 }
 
-// lineStart returns the sequence of bytes that indicates the start of the
-// 'i'th  dialog line in the SCN file.
-func lineStart(i uint32) []byte {
-	b := make([]byte, 5)
-	b[0] = 0xf3
-	binary.LittleEndian.PutUint32(b[1:], i)
-	return b
+// lineTerminator returns the byte that indicates the end of a line, choice or
+// file tag in the SCN file.
+func lineTerminator() byte {
+	if *terminatorFlag > 0xff {
+		log.Fatalln("invalid lineTerminator: ", *terminatorFlag)
+	}
+	return byte(*terminatorFlag)
 }
 
-// choiceStart returns the sequence of bytes that indicates the start of a
-// choice in the SCN file.
-func choiceStart() []byte {
-	return []byte{0xf0, 0x1c, 0xf1}
+// parser returns the Parser for the -lineTerminator and -checkLineIndices.
+func parser() scn.Parser {
+	return scn.Parser{Terminator: lineTerminator(), CheckIndices: *checkLineIndices}
 }
 
-// fileTagStart returns the sequence of bytes that indicates the start of a
-// file name that is the destination of a choice.
-func fileTagStart() []byte {
-	return []byte{0xf0, 0x1a, 0xf1}
+// splitFile parses the SCN file base with the -lineTerminator. If
+// -allowLossyParse is set, segments that cannot be combined back into the
+// original data only log a warning, as do missing line indices found by
+// -checkLineIndices.
+func splitFile(base string, data []byte) ([]*scn.Segment, error) {
+	p := parser()
+	split, err := p.SplitFile(data)
+	if isParseWarning(err) {
+		log.Printf("WARNING: %s: %v", base, err)
+		return split, nil
+	}
+	return split, explainParseError(err)
 }
 
-// parseJIS takes a slice of shift-JIS encoded text and returns it as a UTF-8
-// encoded string. Returns an empty string on failure
-func parseJIS(data []byte) string {
-	utf8Bytes, err := jisDecoder.Bytes(data)
-	if err != nil {
-		return ""
-	}
+// isParseWarning reports whether err is a parse error that splitFile only
+// warns about.
+func isParseWarning(err error) bool {
+	return errors.Is(err, scn.ErrLossyParse) && *allowLossyParse || errors.Is(err, scn.ErrMissingLineIndex)
+}
 
-	return string(utf8Bytes)
+// explainParseError adds the -lineTerminator to errors about lines without
+// one, since the wrong terminator is the usual cause.
+func explainParseError(err error) error {
+	if errors.Is(err, scn.ErrNoTerminator) {
+		return fmt.Errorf("%v with -lineTerminator 0x%02x", err, lineTerminator())
+	}
+	return err
 }
 
 // Log iff verbose flag is true.
@@ -91,462 +160,2030 @@ func logV(format string, v ...interface{}) {
 }
 
 // TLLine is the CSV format that stores original game text with associated
-// translations.
+// translations. The json tags match the csv tags for the json output format.
 type TLLine struct {
-	Filename       string `csv:"FILENAME"`
-	Key            string `csv:"KEY"`
-	Index          int    `csv:"INDEX"`
-	Length         int    `csv:"LENGTH"`
-	TranslatedText string `csv:"TRANSLATED_TEXT"`
-	EdittedText    string `csv:"EDITTED_TEXT"`
+	Filename       string `csv:"FILENAME" json:"FILENAME"`
+	Key            string `csv:"KEY" json:"KEY"`
+	Index          int    `csv:"INDEX" json:"INDEX"`
+	Length         int    `csv:"LENGTH" json:"LENGTH"`
+	TranslatedText string `csv:"TRANSLATED_TEXT" json:"TRANSLATED_TEXT"`
+	EdittedText    string `csv:"EDITTED_TEXT" json:"EDITTED_TEXT"`
+	Status         string `csv:"STATUS" json:"STATUS"`
+	LineStatus     string `csv:"LINE_STATUS" json:"LINE_STATUS"`
+	Destination    string `csv:"DESTINATION" json:"DESTINATION"`
+	// Speaker is the speaker name that -speakerColumn moved out of the
+	// original text. It can be translated, and is patched in front of the
+	// translation.
+	Speaker      string `csv:"SPEAKER" json:"SPEAKER"`
+	OriginalText string `csv:"ORIGINAL_TEXT" json:"ORIGINAL_TEXT"`
+	// PrevText and NextText are the original text of the text lines before
+	// and after the line, written by extract with -withContext.
+	PrevText string `csv:"PREV_TEXT" json:"PREV_TEXT"`
+	NextText string `csv:"NEXT_TEXT" json:"NEXT_TEXT"`
+
+	// Source and Row are the translated CSV the line was read from and its
+	// row in it, numbered as csv-lint does, so that warnings point at the
+	// row in the sheet.
+	Source string `csv:"-" json:"-"`
+	Row    int    `csv:"-" json:"-"`
+	// Comments are the comment rows of the CSV before the line, and after it
+	// if it is the last line, so that sheet mode can write them back.
+	Comments []csvComment `csv:"-" json:"-"`
 }
 
-type SegmentType string
+// csvComment is a comment row of a translated CSV.
+type csvComment struct {
+	// Row is the row of the comment, numbered like TLLine.Row.
+	Row    int
+	Record []string
+}
 
-const (
-	TextSegment    SegmentType = "text"
-	ChoiceSegment  SegmentType = "choice"
-	FileTagSegment SegmentType = "filetag"
-)
+// location returns the translated CSV and row the line was read from.
+func (l *TLLine) location() string {
+	return fmt.Sprintf("%s row %d", l.Source, l.Row)
+}
 
-// ScnSegment represents a portion of an SCN file.
-type ScnSegment struct {
-	lineType  SegmentType
-	lineIndex int
-	data      []byte
+// fuzzyStatus is the STATUS or LINE_STATUS of a translation that still needs
+// to be checked.
+const fuzzyStatus = "fuzzy"
+
+// manualStatus is the LINE_STATUS of a translation whose line breaks were
+// placed by hand. It is patched in without normalizing spaces or word
+// wrapping.
+const manualStatus = "manual"
+
+// needsReviewStatus is the LINE_STATUS of a translation whose original text
+// changed since it was translated.
+const needsReviewStatus = "needs-review"
+
+// statusPriority orders lines by how much work they still need: untranslated
+// lines first, then fuzzy lines and lines that need review, then translated
+// lines.
+func statusPriority(l *TLLine) int {
+	switch {
+	case translation(l) == "":
+		return 0
+	case l.Status == fuzzyStatus || l.LineStatus == fuzzyStatus || l.LineStatus == needsReviewStatus:
+		return 1
+	default:
+		return 2
+	}
 }
 
-func dumpSegments(segments []*ScnSegment) string {
+func dumpSegments(segments []*scn.Segment) string {
 	var out strings.Builder
 
 	offset := 0
 	for _, ss := range segments {
-		if ss.lineType == TextSegment {
-			out.WriteString(fmt.Sprintf("offset: %d (%x)\nlineType: %s\nlineIndex: %d\nshiftjis: %s\n\n", offset, offset, ss.lineType, ss.lineIndex, parseJIS(ss.data)))
+		if !dumpSegment(ss) {
+			offset += len(ss.Data)
+			continue
+		}
+		if ss.Type == scn.TextSegment {
+			out.WriteString(fmt.Sprintf("offset: %d (%x)\nlineType: %s\nlineIndex: %d\nshiftjis: %s\n\n", offset, offset, ss.Type, ss.Index, scn.Decode(ss.Data)))
 		} else {
-			out.WriteString(fmt.Sprintf("offset: %d (%x)\nlineType: %s\nlineIndex: %d\ndata:\n%s\n", offset, offset, ss.lineType, ss.lineIndex, hex.Dump(ss.data)))
+			out.WriteString(fmt.Sprintf("offset: %d (%x)\nlineType: %s\nlineIndex: %d\ndata:\n%s\n", offset, offset, ss.Type, ss.Index, hex.Dump(ss.Data)))
 		}
-		offset += len(ss.data)
+		offset += len(ss.Data)
 	}
 
 	return out.String()
 }
 
-// splitFile parses an SCN file into a slice of ScnSegments.
-func splitFile(data []byte) []*ScnSegment {
-	var out []*ScnSegment
+// removePPNewLines converts Pure Pure new line indicators ("\N") into new
+// lines. The FOTS translation also used "\n".
+func removePPNewLines(s string) string {
+	return strings.Replace(strings.Replace(s, "\\N", "\n", -1), "\\n", "\n", -1)
+}
+
+// splitMarkerRE matches the marker that separates the parts of a
+// translation that are written as consecutive lines sharing the same index.
+// The marker is -splitMarker on its own line. The marker anywhere else is
+// left alone, and a line consisting of literal tildes can be written by
+// escaping the first one ("\~~~~"). It is set by main.
+var splitMarkerRE *regexp.Regexp
+
+// joinSplitLines joins the text of two lines sharing the same index with the
+// split marker.
+func joinSplitLines(first, second string) string {
+	return first + "\n" + *splitMarker + "\n" + second
+}
 
-	remaining := data
+// halfWidthKatakanaRE matches runs of half-width katakana and punctuation.
+var halfWidthKatakanaRE = regexp.MustCompile(`[\x{FF61}-\x{FF9F}]+`)
 
-	indexMap := make(map[SegmentType]int)
-	for {
-		lineType := TextSegment
-		ls := lineStart(uint32(indexMap[lineType]))
-		begin := bytes.Index(remaining, ls)
-		if choiceBegin := bytes.Index(remaining, choiceStart()); choiceBegin != -1 && (begin == -1 || choiceBegin < begin) {
-			ls = choiceStart()
-			begin = choiceBegin
-			lineType = ChoiceSegment
-		}
-		if fileTagBegin := bytes.Index(remaining, fileTagStart()); fileTagBegin != -1 && (begin == -1 || fileTagBegin < begin) {
-			ls = fileTagStart()
-			begin = fileTagBegin
-			lineType = FileTagSegment
-		}
+// widenKatakana converts half-width katakana in s to full-width, combining
+// separate voiced sound marks as NFKC does. Other characters are left as is.
+func widenKatakana(s string) string {
+	return halfWidthKatakanaRE.ReplaceAllStringFunc(s, norm.NFKC.String)
+}
 
-		if begin == -1 {
-			// no more data
-			out = append(out, &ScnSegment{data: remaining})
-			break
-		}
-		begin += len(ls)
-		length := bytes.IndexByte(remaining[begin:], 0)
-		if length == -1 {
-			log.Fatal("did not find end to line")
-		}
-		out = append(out, &ScnSegment{data: remaining[:begin]})
-		out = append(out, &ScnSegment{lineType: lineType, lineIndex: indexMap[lineType], data: remaining[begin : begin+length]})
-		remaining = remaining[begin+length:]
+var spacesRE = regexp.MustCompile(` {2,}`)
+var indentRE = regexp.MustCompile(`^ *`)
 
-		// The FOTS translation added new lines, usually with the same index as the
-		// preceding line. Include these as text lines with the same index as the
-		// original.
-		if !(lineType == TextSegment && bytes.Index(remaining, ls) != -1) {
-			indexMap[lineType]++
+// normalizeSpaces collapses runs of spaces into a single space, leaving
+// spaces inside control codes alone. Leading spaces on each line are kept if
+// -keepIndentation is set.
+func normalizeSpaces(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		indent := ""
+		if *keepIndentation {
+			indent = indentRE.FindString(line)
+			line = line[len(indent):]
 		}
+		var out strings.Builder
+		last := 0
+		for _, m := range controlCodeRE.FindAllStringIndex(line, -1) {
+			out.WriteString(spacesRE.ReplaceAllString(line[last:m[0]], " "))
+			out.WriteString(line[m[0]:m[1]])
+			last = m[1]
+		}
+		out.WriteString(spacesRE.ReplaceAllString(line[last:], " "))
+		lines[i] = indent + out.String()
 	}
+	return strings.Join(lines, "\n")
+}
 
-	if !bytes.Equal(data, combineSegments(out)) {
-		log.Fatal("splitFile messed up :(")
+// commentRE matches a translator note, from -commentStart to -commentEnd. It
+// is set by main, and is nil if notes are kept.
+var commentRE *regexp.Regexp
+
+// stripComments removes the translator notes from s.
+func stripComments(s string) string {
+	if commentRE == nil {
+		return s
 	}
-	return out
+	return commentRE.ReplaceAllString(s, "")
 }
 
-// combineSegments returns the passed slice of ScnSegments as a single slice
-// of bytes that can be written as an SCN file.
-func combineSegments(segs []*ScnSegment) []byte {
-	var out []byte
-	for _, s := range segs {
-		out = append(out, s.data...)
+// unescapeTildes converts escaped tildes ("\~") into literal tildes.
+func unescapeTildes(s string) string {
+	return strings.ReplaceAll(s, "\\~", "~")
+}
+
+// addPPNewLines converts new lines into Pure Pure new line indicators
+// ("\N").
+func addPPNewLines(s string) string {
+	return strings.Replace(s, "\n", "\\N", -1)
+}
+
+// readLines returns the decoded text of every segment in the SCN files
+// matching glob, keyed by scn.Key.
+func readLines(glob string) map[string]string {
+	lineMap := make(map[string]string)
+	paths, err := globScn(glob)
+	Fatal(err)
+	for _, path := range paths {
+		base := filepath.Base(path)
+		data, err := readScn(path)
+		Fatal(err)
+		split, err := splitFile(base, data)
+		if err != nil {
+			log.Printf("WARNING: skipping %s: %v", base, err)
+			continue
+		}
+		for _, ss := range split {
+			if ss.Type == "" {
+				continue
+			}
+			v, ok := lineMap[scn.Key(base, ss.Type, ss.Index)]
+			if !ok {
+				lineMap[scn.Key(base, ss.Type, ss.Index)] = scn.Decode(ss.Data)
+			} else {
+				// Split lines are indicated with the split marker on its own line.
+				lineMap[scn.Key(base, ss.Type, ss.Index)] = joinSplitLines(v, scn.Decode(ss.Data))
+			}
+		}
 	}
-	return out
+	return lineMap
 }
 
-func fixFileSizeHeader(base string, data []byte, fileSizeOffset uint32, segs []*ScnSegment) {
-	binary.LittleEndian.PutUint32(data, uint32(len(data))-fileSizeOffset)
-	if fileSizeOffset <= 12 {
+func extract() {
+	switch *outputFormat {
+	case "csv", "json":
+	case "json-segments":
+		writeJSONSegments()
 		return
+	default:
+		log.Fatalln("invalid outputFormat: ", *outputFormat)
+	}
+	if *mergeInto != "" && (*outputFormat != "csv" || *splitOutput || *singleFile != "" || filtering()) {
+		log.Fatalln("-mergeInto requires -outputFormat csv without -splitOutput, -file or filters")
 	}
-	numChoices := (fileSizeOffset - 12) / 36
+	checkFilters()
+	lineMap := make(map[string]string)
 
-	var pos uint32
-	var choicePos []uint32
-	for _, ss := range segs {
-		if ss.lineType == FileTagSegment {
-			choicePos = append(choicePos, pos)
+	if *engScnFileFlag != "" {
+		engGlob := *engScnFileFlag
+		if *singleFile != "" {
+			// Only the English file of the same name is needed.
+			engGlob = filepath.Join(filepath.Dir(engGlob), filepath.Base(*singleFile))
 		}
-		pos += uint32(len(ss.data))
+		lineMap = readLines(engGlob)
 	}
-	if uint32(len(choicePos)) != numChoices {
-		log.Printf("WARNING: %v header suggests there should be %v choices, but only found %v in file", base, numChoices, len(choicePos))
-		return
+
+	// extractFile returns the lines of a single file. It is called
+	// concurrently, so it only reads lineMap.
+	extractFile := func(path string) ([]*TLLine, error) {
+		base := filepath.Base(path)
+		if !filterFileMatch(base) {
+			return nil, nil
+		}
+		data, err := readScn(path)
+		Fatal(err)
+		split, err := splitFile(base, data)
+		if err != nil {
+			return nil, err
+		}
+		if *singleFile != "" {
+			fmt.Printf("==== %s ====\n%s\n", base, formatSegments(split))
+		}
+		return filterTLLines(fileTLLines(base, split, lineMap)), nil
 	}
 
-	for i := uint32(0); i < numChoices; i++ {
-		binary.LittleEndian.PutUint32(data[12+(36*i)+32:], choicePos[i]-fileSizeOffset-uint32(len(fileTagStart())))
+	paths := extractPaths()
+	perFile := make([][]*TLLine, len(paths))
+	fileErrs := make([]error, len(paths))
+	progress := newProgressLine("extracting", len(paths))
+	parallel(len(paths), func(i int) {
+		perFile[i], fileErrs[i] = extractFile(paths[i])
+		progress.step()
+	})
+	progress.finish()
+	var tlLines []*TLLine
+	for i, path := range paths {
+		if fileErrs[i] != nil {
+			log.Printf("WARNING: skipping %s: %v", filepath.Base(path), fileErrs[i])
+			continue
+		}
+		tlLines = append(tlLines, perFile[i]...)
 	}
-}
 
-// getFileSizeHeader takes an SCN file, and returns the file size header
-// stored as a 4-byte little endian value at the start of the file.
-func getFileSizeHeader(data []byte) uint32 {
-	return binary.LittleEndian.Uint32(data)
-}
+	if *sortByStatus {
+		sort.SliceStable(tlLines, func(i, j int) bool {
+			return statusPriority(tlLines[i]) < statusPriority(tlLines[j])
+		})
+	}
 
-func mapKey(base string, st SegmentType, lineIndex int) string {
-	return fmt.Sprintf("%v-%v-%v", base, st, lineIndex)
-}
+	if *splitOutput || *singleFile != "" {
+		// Write one CSV per SCN file, named after the SCN file.
+		var files []string
+		fileLines := make(map[string][]*TLLine)
+		for _, l := range tlLines {
+			if _, ok := fileLines[l.Filename]; !ok {
+				files = append(files, l.Filename)
+			}
+			fileLines[l.Filename] = append(fileLines[l.Filename], l)
+		}
+		for _, file := range files {
+			writeTLLines(strings.TrimSuffix(file, filepath.Ext(file)), fileLines[file])
+		}
+		return
+	}
 
-// removePPNewLines converts Pure Pure new line indicators ("\N") into new
-// lines. The FOTS translation also used "\n".
-func removePPNewLines(s string) string {
-	return strings.Replace(strings.Replace(s, "\\N", "\n", -1), "\\n", "\n", -1)
+	if *mergeInto != "" {
+		merged, err := mergeTLLines(*mergeInto, tlLines)
+		Fatal(err)
+		Fatal(writeFile(filepath.Join(*outputFolder, "tllines.csv"), withBOM(merged)))
+		return
+	}
+	writeTLLines("tllines", tlLines)
 }
 
-// addPPNewLines converts new lines into Pure Pure new line indicators
-// ("\N").
-func addPPNewLines(s string) string {
-	return strings.Replace(s, "\n", "\\N", -1)
+// writeTLLines writes lines to name in outputFolder in the -outputFormat,
+// with the format's extension.
+func writeTLLines(name string, lines []*TLLine) {
+	if *outputFormat == "json" {
+		if lines == nil {
+			lines = []*TLLine{}
+		}
+		out, err := json.MarshalIndent(lines, "", "  ")
+		Fatal(err)
+		Fatal(writeFile(filepath.Join(*outputFolder, name+".json"), out))
+		return
+	}
+	out, err := gocsv.MarshalBytes(lines)
+	Fatal(err)
+	Fatal(writeFile(filepath.Join(*outputFolder, name+".csv"), withBOM(out)))
 }
 
-func extract() {
-	lineMap := make(map[string]string)
-
-	if *engScnFileFlag != "" {
-		paths, err := filepath.Glob(*engScnFileFlag)
+// addContext fills in the PrevText and NextText of lines, the lines of a
+// file in order, from the text lines around them. File tags are names of
+// files, which are of no help to translators, so they are left empty.
+func addContext(lines []*TLLine) {
+	prev := ""
+	for _, l := range lines {
+		_, st, _, err := scn.ParseKey(l.Key)
 		Fatal(err)
-		for _, path := range paths {
-			base := filepath.Base(path)
-			data, err := ioutil.ReadFile(path)
-			Fatal(err)
-			split := splitFile(data)
-			for _, ss := range split {
-				if ss.lineType == "" {
-					continue
-				}
-				v, ok := lineMap[mapKey(base, ss.lineType, ss.lineIndex)]
-				if !ok {
-					lineMap[mapKey(base, ss.lineType, ss.lineIndex)] = parseJIS(ss.data)
-				} else {
-					// Split lines are indicated with ~~~~ on its own line.
-					lineMap[mapKey(base, ss.lineType, ss.lineIndex)] = v + "\n~~~~\n" + parseJIS(ss.data)
+		if st != scn.FileTagSegment {
+			l.PrevText = prev
+		}
+		if st == scn.TextSegment {
+			prev = l.OriginalText
+		}
+	}
+	next := ""
+	for i := len(lines) - 1; i >= 0; i-- {
+		l := lines[i]
+		_, st, _, err := scn.ParseKey(l.Key)
+		Fatal(err)
+		if st != scn.FileTagSegment {
+			l.NextText = next
+		}
+		if st == scn.TextSegment {
+			next = l.OriginalText
+		}
+	}
+}
+
+// fileTLLines returns the lines extract writes for the segments of the SCN
+// file base, with the translations in lineMap.
+func fileTLLines(base string, split []*scn.Segment, lineMap map[string]string) []*TLLine {
+	var fileLines []*TLLine
+	var pendingChoices []*TLLine
+	for _, ss := range split {
+		if ss.Type == "" {
+			continue
+		}
+		tlline := &TLLine{
+			Filename:     base,
+			Key:          scn.Key(base, ss.Type, ss.Index),
+			Index:        ss.Index,
+			Length:       len(ss.Data),
+			OriginalText: scn.Decode(ss.Data)}
+		if *normalizeOriginal {
+			tlline.OriginalText = widenKatakana(tlline.OriginalText)
+		}
+		// TrimSpace because earlier translation added padding as space to
+		// maintain line length.
+		tlltext := strings.TrimSpace(removePPNewLines(lineMap[scn.Key(base, ss.Type, ss.Index)]))
+		if *speakerColumn && ss.Type == scn.TextSegment {
+			tlline.Speaker, tlline.OriginalText = splitSpeaker(speakerRE, tlline.OriginalText)
+			// Keep the translated name of an earlier translation.
+			if speaker, body := splitSpeaker(translatedSpeakerRE, tlltext); tlline.Speaker != "" && speaker != "" {
+				tlline.Speaker, tlltext = speaker, body
+			}
+		}
+		if tlltext != "" {
+			tlline.TranslatedText = tlltext
+		}
+		if *linkChoices {
+			// Each file tag is the destination of the earliest choice that
+			// does not have one yet.
+			switch ss.Type {
+			case scn.ChoiceSegment:
+				pendingChoices = append(pendingChoices, tlline)
+			case scn.FileTagSegment:
+				if len(pendingChoices) != 0 {
+					pendingChoices[0].Destination = scn.Decode(ss.Data)
+					pendingChoices = pendingChoices[1:]
 				}
 			}
 		}
+		fileLines = append(fileLines, tlline)
 	}
+	if *withContext {
+		addContext(fileLines)
+	}
+	return fileLines
+}
 
-	paths, err := filepath.Glob(*scnFileFlag)
+// extractPaths returns the SCN files to extract: the files matching
+// -scnFiles, or only the one named by -file if it is set.
+func extractPaths() []string {
+	if *singleFile != "" {
+		if matches, err := fsys.Glob(*singleFile); err == nil && len(matches) == 1 {
+			return matches
+		}
+	}
+	paths, err := globScn(*scnFileFlag)
 	Fatal(err)
-	var tlLines []*TLLine
+	if *singleFile == "" {
+		return paths
+	}
 	for _, path := range paths {
-		data, err := ioutil.ReadFile(path)
-		Fatal(err)
-		split := splitFile(data)
-		for _, ss := range split {
-			if ss.lineType == "" {
-				continue
-			}
-			base := filepath.Base(path)
-			tlline := &TLLine{
-				Filename: base,
-				Key:      mapKey(base, ss.lineType, ss.lineIndex),
-				Index:    ss.lineIndex,
-				Length:   len(ss.data)}
-			// TrimSpace because earlier translation added padding as space to
-			// maintain line length.
-			tlltext := strings.TrimSpace(removePPNewLines(lineMap[mapKey(base, ss.lineType, ss.lineIndex)]))
-			if tlltext != "" {
-				tlline.TranslatedText = tlltext
-			}
-			tlLines = append(tlLines, tlline)
+		if filepath.Base(path) == *singleFile {
+			return []string{path}
 		}
+	}
+	log.Fatalln("no file matching -scnFiles is named ", *singleFile)
+	return nil
+}
 
+// withBOM prepends a UTF-8 byte order mark to data if -csvBOM is set.
+func withBOM(data []byte) []byte {
+	if !*csvBOM {
+		return data
 	}
+	return append([]byte("\ufeff"), data...)
+}
 
-	tlLinesCsv, err := gocsv.MarshalBytes(tlLines)
-	err = ioutil.WriteFile(filepath.Join(*outputFolder, "tllines.csv"), []byte(tlLinesCsv), 0644)
-	Fatal(err)
+// splitList returns the set of non-empty items in the comma separated list
+// s.
+func splitList(s string) map[string]bool {
+	out := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out[item] = true
+		}
+	}
+	return out
 }
 
 func isURL(s string) bool {
 	return strings.HasPrefix(s, "http")
 }
 
-func download(url string) []byte {
+func download(url, cachePath string) []byte {
+	if cachePath == "" {
+		if *offline {
+			log.Fatalln("-offline requires -csvCache")
+		}
+		data, _, err := get(url, nil)
+		Fatal(err)
+		return data
+	}
+	return downloadCached(url, cachePath)
+}
+
+// retryableError is a download error that may succeed if retried.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+// get downloads url with the extra request headers, retrying up to
+// -downloadRetries times with exponential backoff. It returns the response
+// headers, and no data if the server responds that the cached copy is still
+// current.
+func get(url string, header http.Header) ([]byte, http.Header, error) {
+	delay := *downloadRetryDelay
+	for retry := 0; ; retry++ {
+		data, respHeader, err := getOnce(url, header)
+		var rErr *retryableError
+		if !errors.As(err, &rErr) {
+			return data, respHeader, err
+		}
+		if retry >= *downloadRetries {
+			return nil, nil, rErr.err
+		}
+		log.Printf("WARNING: %v, retrying in %v", rErr.err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// getOnce makes a single attempt of get.
+func getOnce(url string, header http.Header) ([]byte, http.Header, error) {
 	log.Print("downloading translation from ", url)
-	resp, err := http.Get(url)
-	Fatal(err)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, &retryableError{err}
+	}
 	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil, resp.Header, nil
+	case resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		// Google responds with these when rate limiting.
+		return nil, nil, &retryableError{fmt.Errorf("downloading %s: %s", url, resp.Status)}
+	case resp.StatusCode != http.StatusOK:
+		return nil, nil, fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
 
 	var buf bytes.Buffer
 	_, err = buf.ReadFrom(resp.Body)
-	Fatal(err)
-	return buf.Bytes()
+	if err != nil {
+		return nil, nil, &retryableError{err}
+	}
+	if isHTML(resp.Header.Get("Content-Type"), buf.Bytes()) {
+		return nil, nil, fmt.Errorf("expected CSV from %s, got HTML; is the sheet public?", url)
+	}
+	return buf.Bytes(), resp.Header, nil
 }
 
-func strictSizeMode(base string) bool {
-	switch base {
-	case "2_6_6.scn", "4_12_1.scn":
+// isHTML returns true if a response is an HTML page, like the login page
+// Google Sheets serves for private sheets, rather than CSV.
+func isHTML(contentType string, data []byte) bool {
+	if strings.HasPrefix(contentType, "text/html") {
 		return true
 	}
-	return false
+	if len(data) > 64 {
+		data = data[:64]
+	}
+	start := strings.ToLower(string(bytes.TrimSpace(data)))
+	return strings.HasPrefix(start, "<!doctype html") || strings.HasPrefix(start, "<html")
 }
 
-var colorRE = regexp.MustCompile(`\\c[0-9]+`)
-var voiceRE = regexp.MustCompile(`\\V\"[^\"]*\""`)
-
-func lineLength(s string) int {
-	s = colorRE.ReplaceAllString(s, "")
-	s = voiceRE.ReplaceAllString(s, "")
-	return len(s)
+// csvCacheInfo is stored next to the -csvCache file to make conditional
+// requests for the translated CSV.
+type csvCacheInfo struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
 }
 
-func wrap(s string) string {
-	lines := strings.Split(s, "\n")
-	var wrappedLines []string
-	for _, line := range lines {
-		parts := strings.Split(strings.TrimSuffix(line, " "), " ")
-		var curLine []string
-
-		for _, p := range parts {
-			curLine = append(curLine, p)
-			if lineLength(strings.Join(curLine, " ")) > *wordWrapLength {
-				wrappedLines = append(wrappedLines, strings.Join(curLine[:len(curLine)-1], " "))
-				curLine = nil
-				curLine = append(curLine, p)
+// downloadCached downloads url unless the copy in cachePath is still current,
+// and updates the cache. If the download fails, or -offline is set, the
+// cached copy is used instead.
+func downloadCached(url, cachePath string) []byte {
+	infoPath := cachePath + ".json"
+	cached, cacheErr := fsys.ReadFile(cachePath)
+	var info csvCacheInfo
+	if cacheErr == nil {
+		if data, err := fsys.ReadFile(infoPath); err == nil {
+			if err := json.Unmarshal(data, &info); err != nil {
+				log.Printf("WARNING: ignoring %s: %v", infoPath, err)
 			}
 		}
-		if len(curLine) != 0 {
-			wrappedLines = append(wrappedLines, strings.Join(curLine, " "))
+		if info.URL != url {
+			// The cache is of a different sheet, so it cannot be revalidated.
+			info = csvCacheInfo{}
 		}
 	}
-	return strings.Join(wrappedLines, "\n")
-}
-
-func hexEncode(data []byte) string {
-	var out strings.Builder
-	hexStr := hex.EncodeToString(data)
+	if *offline {
+		Fatal(cacheErr)
+		log.Print("using cached translation ", cachePath)
+		return cached
+	}
 
-	for i := 0; i < len(hexStr)/2; i++ {
-		out.WriteByte(hexStr[2*i])
-		out.WriteByte(hexStr[(2*i)+1])
-		if i != (len(hexStr)/2)-1 {
-			out.WriteRune(' ')
+	header := make(http.Header)
+	if cacheErr == nil && info.ETag != "" {
+		header.Set("If-None-Match", info.ETag)
+	}
+	if cacheErr == nil && info.LastModified != "" {
+		header.Set("If-Modified-Since", info.LastModified)
+	}
+	data, respHeader, err := get(url, header)
+	if err != nil {
+		if cacheErr != nil {
+			Fatal(err)
 		}
+		log.Printf("WARNING: using cached translation %s: %v", cachePath, err)
+		return cached
+	}
+	if data == nil {
+		log.Print("translation has not changed, using cached translation ", cachePath)
+		return cached
 	}
-	return out.String()
-}
 
-func hexDecode(data string) []byte {
-	out, err := hex.DecodeString(strings.ReplaceAll(data, " ", ""))
+	info = csvCacheInfo{URL: url, ETag: respHeader.Get("ETag"), LastModified: respHeader.Get("Last-Modified")}
+	infoData, err := json.Marshal(&info)
 	Fatal(err)
-	return out
+	Fatal(writeFile(cachePath, data))
+	Fatal(writeFile(infoPath, infoData))
+	return data
 }
 
-var reBubble0 = regexp.MustCompile("f0 45 f2 .. .. .. .. f2 .. .. .. .. f2 .. .. .. .. f2 .. .. .. ..")
-var reBubble1 = regexp.MustCompile("f0 46 f2 .. .. .. .. f0 20")
-var reBubble2 = regexp.MustCompile("f0 46 f2 07 00 00 00")
-
-func removeBubbles(data []byte) []byte {
-	hexStr := hexEncode(data)
-	hexStr = reBubble0.ReplaceAllString(hexStr, "")
-	hexStr = reBubble1.ReplaceAllString(hexStr, "")
-	hexStr = reBubble2.ReplaceAllString(hexStr, "")
-	return hexDecode(hexStr)
+// paddingBytes returns the -strictSizePadding as bytes. The padding must
+// stay part of the padded line, so it may not contain a terminator or start
+// a new segment when repeated.
+func paddingBytes() []byte {
+	var padding []byte
+	var err error
+	if strings.HasPrefix(*strictSizePadding, "0x") {
+		padding, err = hex.DecodeString(strings.TrimPrefix(*strictSizePadding, "0x"))
+	} else {
+		padding, err = scn.Encode(*strictSizePadding)
+	}
+	if err != nil || len(padding) == 0 {
+		log.Fatalln("invalid strictSizePadding: ", *strictSizePadding)
+	}
+	parser := &scn.Parser{Terminator: lineTerminator()}
+	line := bytes.Repeat(padding, 3)
+	split, err := parser.SplitFile(append(append(scn.LineStart(0), line...), lineTerminator()))
+	if err != nil || len(split) != 3 || !bytes.Equal(split[1].Data, line) {
+		log.Fatalf("invalid strictSizePadding: %q would end the padded line or start a new segment", *strictSizePadding)
+	}
+	if text, err := scn.Encode(scn.Decode(padding)); err != nil || !bytes.Equal(text, padding) {
+		log.Printf("WARNING: -strictSizePadding %q is not text in -encoding %s, and may combine with the byte after it", *strictSizePadding, *encodingFlag)
+	}
+	return padding
 }
 
-var reRouteChange = regexp.MustCompile("f2 .. .. .. .. f0 1a f1")
+// strictSizeFiles is the set of -strictSizeFiles. It is set in main.
+var strictSizeFiles map[string]bool
 
-func fixRouteChange(file string, data []byte, fileSizeDiff int) []byte {
-	switch file {
-	case "4_9_7.scn":
-	case "4_10_2.scn":
-	case "4_13_9.scn":
-	case "5_10_1.scn":
-		break
-	default:
-		return data
-	}
-	hexStr := hexEncode(data)
-
-	hexStr = reRouteChange.ReplaceAllStringFunc(hexStr, func(s string) string {
-		offsetStr := s[3 : 3+11]
-		offset := getFileSizeHeader(hexDecode(offsetStr))
-		offset = uint32(int(offset) + fileSizeDiff)
-		offsetBytes := make([]byte, 4)
-		binary.LittleEndian.PutUint32(offsetBytes, offset)
-		newOffsetStr := hexEncode(offsetBytes)
-		out := "f2 " + newOffsetStr + " f0 1a f1"
-		logV("%s: updating route change offset from %q to %q\n%q\n%q", file, offsetStr, newOffsetStr, s, out)
-		return out
-	})
+// strictSizeMode returns true if base is one of the -strictSizeFiles.
+func strictSizeMode(base string) bool {
+	return strictSizeFiles[base]
+}
 
-	return hexDecode(hexStr)
-}
-
-func fotsPatches(file string, data []byte) []byte {
-	switch file {
-	case "1_6_2.scn":
-		// Patch for 1_6_2 (present from sachi scene).
-		// Adds the "try your best" CG and keeps music playing at the end of the scene.
-		hexStr := hexEncode(data)
-		hexStr = strings.ReplaceAll(hexStr, "f3 19 00 00", "f0 23 f2 07 00 00 00 f2 80 00 00 00 f2 2c 01 00 00 f2 00 00 00 00 f0 20 f3 19 00 00")
-		hexStr = strings.ReplaceAll(hexStr, "f0 2d f2 b8 0b 00 00 f3 1d", "f0 19 f1 50 50 4e 31 4e 00 f2 00 00 00 00 f2 80 00 00 00 f2 a0 0f 00 00 f2 01 00 00 00 f0 20 f3 1d")
-		hexStr = strings.ReplaceAll(hexStr, "f3 22 00 00 00", "f0 19 f1 50 50 4e 32 4e 00 f2 00 00 00 00 f2 80 00 00 00 f2 a0 0f 00 00 f2 01 00 00 00 f0 20 f3 22 00 00 00")
-		hexStr = strings.ReplaceAll(hexStr, "f0 23 f2 07 00 00 00 f2 80 00 00 00 f2 2c 01 00 00 f2 00 00 00 00 f0 20 f3 26 00 00 00", "f3 26 00 00 00")
-		return hexDecode(hexStr)
-	case "1_5_22.scn":
-		// Change BGM01 to BGM19.
-		hexStr := hexEncode(data)
-		hexStr = strings.ReplaceAll(hexStr, "42 47 4d 30 31", "42 47 4d 31 39")
-		return hexDecode(hexStr)
-	default:
-		return data
-	}
+var colorRE = regexp.MustCompile(`\\c[0-9]+`)
 
-}
+// voiceRE matches a voice tag, which may contain spaces between its quotes.
+// Some lines close the tag with a doubled quote.
+var voiceRE = regexp.MustCompile(`\\V"[^"]*""?`)
 
-func patch() {
-	// log.Println("output scn directory: ", *outputScnFolder)
-	var tlLines []*TLLine
-	var data []byte
-	var err error
-	if !isURL(*translatedCsv) {
-		data, err = ioutil.ReadFile(*translatedCsv)
+// untranslatedMarker returns the -markUntranslated marker to replace the
+// untranslated segment ss with, cut to the original length if base is in
+// strict size mode.
+func untranslatedMarker(base string, ss *scn.Segment) []byte {
+	if len(ss.Data) == 0 {
+		return nil
+	}
+	marker := []rune(*markUntranslated)
+	for len(marker) != 0 {
+		jis, err := scn.Encode(string(marker))
 		Fatal(err)
-	} else {
-		data = download(*translatedCsv)
+		if !strictSizeMode(base) || len(jis) <= len(ss.Data) {
+			return jis
+		}
+		marker = marker[:len(marker)-1]
 	}
-	Fatal(gocsv.UnmarshalBytes(data, &tlLines))
+	return nil
+}
 
-	lineMap := make(map[string][]byte)
-	for _, l := range tlLines {
-		// log.Println("processing TL line: ", l)
-		if (l.TranslatedText == "" && l.EdittedText == "") || l.Key == "" {
-			continue
-		}
-		tl := l.TranslatedText
-		if l.EdittedText != "" {
-			tl = l.EdittedText
-		}
-		// Replace name brackets.
-		tl = strings.ReplaceAll(tl, "【", "「")
-		tl = strings.ReplaceAll(tl, "】", "」")
+// trailingVoiceRE matches a voice tag at the end of a line.
+var trailingVoiceRE = regexp.MustCompile(`(?:` + voiceRE.String() + `)\s*$`)
+
+// keepVoiceTag returns the translation line of the original text segment
+// orig, with the voice tag at the end of orig added to it if the translation
+// has no voice tag of its own. The translation sheet often leaves out the
+// tags, and the voice would otherwise not be played.
+func keepVoiceTag(key string, orig, line []byte) []byte {
+	tag := trailingVoiceRE.FindString(scn.Decode(orig))
+	if tag == "" || voiceRE.MatchString(scn.Decode(line)) {
+		return line
+	}
+	// tag is decoded, so it has to be encoded again to be copied.
+	encoded, err := scn.Encode(tag)
+	if err != nil {
+		log.Printf("WARNING: %s: could not keep the voice tag %q of the original: %v", key, tag, err)
+		return line
+	}
+	logV("%s: keeping voice tag %q of the original", key, tag)
+	return append(append([]byte{}, line...), encoded...)
+}
 
-		tlWrapped := wrap(tl)
-		// if tl != tlWrapped {
-		// fmt.Printf("%v\n->\n%v\n\n", tl, tlWrapped)
-		// }
-		jis, err := jisEncoder.Bytes([]byte(addPPNewLines(tlWrapped)))
-		Fatal(err)
-		// Convert "~~~~" back into split lines.
-		jis = bytes.Replace(jis, []byte("\\N~~~~\\N"), append([]byte{0}, lineStart(uint32(l.Index))...), -1)
-		lineMap[l.Key] = jis
+// widthRE matches the word wrap width directive. "\w30" sets the word wrap
+// length to 30 characters for the rest of the text being wrapped, overriding
+// -wordwrap. Unlike the color and voice codes, the game does not understand
+// this directive, so wrap removes it before the line is encoded.
+var widthRE = regexp.MustCompile(`\\w([0-9]+)`)
+
+// pageBreakRE matches the -pageBreak control code and the spaces around it.
+// The code is written as text, like the color and voice codes, so it is
+// encoded as its own bytes in the SCN file. It is set in main if -pageBreak
+// is set.
+var pageBreakRE *regexp.Regexp
+
+// stripControlCodes removes the color, voice, width and page break control
+// codes, which are not rendered as text.
+func stripControlCodes(s string) string {
+	s = colorRE.ReplaceAllString(s, "")
+	s = voiceRE.ReplaceAllString(s, "")
+	if pageBreakRE != nil {
+		s = pageBreakRE.ReplaceAllString(s, "")
 	}
+	return widthRE.ReplaceAllString(s, "")
+}
 
-	baseToReferencePath := make(map[string]string)
-	if *referenceCheck {
-		referencePaths, err := filepath.Glob(*referenceScnFiles)
-		Fatal(err)
-		for _, path := range referencePaths {
-			baseToReferencePath[filepath.Base(path)] = path
-		}
+// lineLength returns the length of s for word wrapping, as selected by
+// -wrapMeasure.
+func lineLength(s string) int {
+	if *wrapMeasure == "bytes" {
+		return len(stripControlCodes(s))
 	}
+	return displayWidth(s)
+}
 
-	paths, err := filepath.Glob(*scnFileFlag)
-	Fatal(err)
-	// log.Println("processing original files: ", paths)
-	for _, path := range paths {
-		data, err := ioutil.ReadFile(path)
-		origDataSize := len(data)
-		Fatal(err)
-		base := filepath.Base(path)
-		// logV("%s segments:\n %v", base, dumpSegments(splitFile(data)))
-		strictSize := strictSizeMode(base)
-		origFileSizeHeader := getFileSizeHeader(data)
-		fileSizeOffset := uint32(len(data)) - origFileSizeHeader
-		if !strictSize {
-			data = removeBubbles(data)
-		}
+// charTokenRE matches a control code or a single character.
+var charTokenRE = regexp.MustCompile(colorRE.String() + "|" + voiceRE.String() + "|" + widthRE.String() + "|.")
 
-		// log.Println(base, fileSizeOffset)
-		split := splitFile(data)
-		for _, ss := range split {
-			if ss.lineType == "" {
+// wrapChars word wraps s by character, for text that is not separated by
+// spaces. Control codes are never split and do not count towards the width.
+func wrapChars(s string, width int) string {
+	var wrappedLines []string
+	for _, line := range strings.Split(s, "\n") {
+		var curLine strings.Builder
+		n := 0
+		for _, tok := range charTokenRE.FindAllString(line, -1) {
+			if m := widthRE.FindStringSubmatch(tok); m != nil {
+				w, err := strconv.Atoi(m[1])
+				Fatal(err)
+				width = w
 				continue
 			}
-			if eng := lineMap[mapKey(base, ss.lineType, ss.lineIndex)]; eng != nil {
-				if strictSize {
-					if len(eng) > len(ss.data) {
-						log.Printf("WARNING: Translation line %q (len: %v) is too long for line %q (len: %v) in strict size mode", eng, len(eng), parseJIS(ss.data), len(ss.data))
-						continue
-					}
-					if len(eng) < len(ss.data) {
-						eng = append(eng, bytes.Repeat([]byte{' '}, len(ss.data)-len(eng))...)
-					}
+			if isControlCodesOnly(tok) {
+				curLine.WriteString(tok)
+				continue
+			}
+			w := 1
+			if *wrapMeasure != "bytes" {
+				w = displayWidth(tok)
+			}
+			if n+w > width {
+				wrappedLines = append(wrappedLines, curLine.String())
+				curLine.Reset()
+				n = 0
+				if tok == " " {
+					continue
 				}
-				// log.Println("inserting translated line ", eng)
-				ss.data = eng
 			}
+			curLine.WriteString(tok)
+			n += w
 		}
-		outData := combineSegments(split)
-		outData = fotsPatches(base, outData)
-		fixFileSizeHeader(base, outData, fileSizeOffset, split)
-		outData = fixRouteChange(base, outData, len(outData)-origDataSize)
-		logV("%s segments:\n %v", base, dumpSegments(splitFile(outData)))
-		err = ioutil.WriteFile(filepath.Join(*outputScnFolder, base), outData, 0700)
+		wrappedLines = append(wrappedLines, curLine.String())
+	}
+	return strings.Join(wrappedLines, "\n")
+}
+
+// WrapOverride is a row of the -wrapOverrides CSV.
+type WrapOverride struct {
+	Filename    string          `csv:"FILENAME"`
+	SegmentType scn.SegmentType `csv:"SEGMENT_TYPE"`
+	WordWrap    int             `csv:"WORDWRAP"`
+}
+
+var wrapOverrides map[string]int
+
+// wrapWidth returns the word wrap width of the segment with the given key.
+// -wrapOverrides rows are tried from the most specific to the least: file and
+// segment type, file, segment type, then "*" alone. Without a match the width
+// is -wordwrap. The overrides are loaded the first time they are needed.
+func wrapWidth(key string) int {
+	if *wrapOverridesFile == "" {
+		return *wordWrapLength
+	}
+	if wrapOverrides == nil {
+		data, err := fsys.ReadFile(*wrapOverridesFile)
 		Fatal(err)
+		var rows []*WrapOverride
+		Fatal(gocsv.UnmarshalBytes(data, &rows))
+		wrapOverrides = make(map[string]int)
+		for _, row := range rows {
+			wrapOverrides[row.Filename+"-"+string(row.SegmentType)] = row.WordWrap
+		}
+	}
+	base, st, _, err := scn.ParseKey(key)
+	if err != nil {
+		return *wordWrapLength
+	}
+	for _, k := range []string{base + "-" + string(st), base + "-", "*-" + string(st), "*-"} {
+		if width, ok := wrapOverrides[k]; ok {
+			return width
+		}
+	}
+	return *wordWrapLength
+}
+
+// splitWords splits line on spaces like strings.Split, except that spaces
+// inside a voice tag do not split it.
+func splitWords(line string) []string {
+	var words []string
+	start := 0
+	tags := voiceRE.FindAllStringIndex(line, -1)
+	for i := 0; i < len(line); i++ {
+		if len(tags) != 0 && i >= tags[0][0] {
+			i = tags[0][1] - 1
+			tags = tags[1:]
+			continue
+		}
+		if line[i] == ' ' {
+			words = append(words, line[start:i])
+			start = i + 1
+		}
+	}
+	return append(words, line[start:])
+}
 
-		if *referenceCheck {
-			referencePath := baseToReferencePath[base]
-			refData, err := ioutil.ReadFile(referencePath)
+// boxLines returns the number of lines of the tallest text box the wrapped
+// parts of a translation are shown in. Each split line and each page after a
+// -pageBreak starts a new text box.
+func boxLines(parts []string) int {
+	most := 0
+	for _, part := range parts {
+		pages := []string{part}
+		if pageBreakRE != nil {
+			pages = pageBreakRE.Split(part, -1)
+		}
+		for _, page := range pages {
+			if n := strings.Count(page, "\\N") + 1; n > most {
+				most = n
+			}
+		}
+	}
+	return most
+}
+
+// wrap word wraps s to width, which can be changed within s with the "\wNN"
+// directive. The text before and after each -pageBreak is wrapped on its own,
+// since the text after a page break starts on a new page.
+func wrap(s string, width int) string {
+	if pageBreakRE == nil {
+		return wrapPage(s, width)
+	}
+	var out strings.Builder
+	last := 0
+	for _, m := range pageBreakRE.FindAllStringIndex(s, -1) {
+		page := s[last:m[0]]
+		out.WriteString(wrapPage(page, width))
+		out.WriteString(s[m[0]:m[1]])
+		// Width directives hold for the rest of the text.
+		if ws := widthRE.FindAllStringSubmatch(page, -1); ws != nil {
+			w, err := strconv.Atoi(ws[len(ws)-1][1])
 			Fatal(err)
-			compare := bytes.Compare(refData, outData)
-			if compare != 0 {
-				log.Printf("mismatch during reference check of %s: %s", base, referencePath)
+			width = w
+		}
+		last = m[1]
+	}
+	out.WriteString(wrapPage(s[last:], width))
+	return out.String()
+}
+
+// wrapPage word wraps text without page breaks.
+func wrapPage(s string, width int) string {
+	switch *wrapMode {
+	case "space":
+	case "char":
+		return wrapChars(s, width)
+	default:
+		log.Fatalln("invalid wrapMode: ", *wrapMode)
+	}
+	lines := strings.Split(s, "\n")
+	var wrappedLines []string
+	for _, line := range lines {
+		parts := splitWords(strings.TrimSuffix(line, " "))
+		var curLine []string
+		lineStart := len(wrappedLines)
+
+		for _, p := range parts {
+			if m := widthRE.FindAllStringSubmatch(p, -1); m != nil {
+				w, err := strconv.Atoi(m[len(m)-1][1])
+				Fatal(err)
+				width = w
+				p = widthRE.ReplaceAllString(p, "")
+				if p == "" {
+					continue
+				}
+			}
+			curLine = append(curLine, p)
+			if lineLength(strings.Join(curLine, " ")) > width {
+				wrappedLines = append(wrappedLines, strings.Join(curLine[:len(curLine)-1], " "))
+				curLine = nil
+				curLine = append(curLine, p)
+			}
+		}
+		if len(curLine) != 0 {
+			wrappedLines = append(wrappedLines, strings.Join(curLine, " "))
+		}
+
+		// Control codes at the end of a line, like a voice tag, must not be
+		// left on a wrapped line of their own, so move them back onto the
+		// previous wrapped line even if that makes it too long.
+		if last := len(wrappedLines) - 1; last > lineStart && isControlCodesOnly(wrappedLines[last]) {
+			merged := wrappedLines[last-1] + " " + wrappedLines[last]
+			if lineLength(merged) > width {
+				log.Printf("WARNING: moving trailing control codes %q onto the previous line makes %q longer than %v", wrappedLines[last], merged, width)
+			}
+			wrappedLines = append(wrappedLines[:last-1], merged)
+		}
+	}
+	return strings.Join(wrappedLines, "\n")
+}
+
+// isControlCodesOnly returns true if s is made up of nothing but control
+// codes and spaces.
+func isControlCodesOnly(s string) bool {
+	return strings.TrimSpace(s) != "" && strings.TrimSpace(stripControlCodes(s)) == ""
+}
+
+// translatedCsvSources returns the CSVs listed in -translatedCsv, with the
+// globs of local files expanded.
+func translatedCsvSources() []string {
+	var sources []string
+	for _, src := range strings.Split(*translatedCsv, ",") {
+		src = strings.TrimSpace(src)
+		if src == "" {
+			continue
+		}
+		if isURL(src) {
+			sources = append(sources, src)
+			continue
+		}
+		paths, err := fsys.Glob(src)
+		Fatal(err)
+		if len(paths) == 0 {
+			// Let ReadFile report the missing file.
+			paths = []string{src}
+		}
+		sources = append(sources, paths...)
+	}
+	return sources
+}
+
+// csvCachePath returns the -csvCache file of url. When -translatedCsv lists
+// more than one URL, each is cached in its own file named after a hash of the
+// URL.
+func csvCachePath(url string, numURLs int) string {
+	if *csvCache == "" || numURLs <= 1 {
+		return *csvCache
+	}
+	sum := sha1.Sum([]byte(url))
+	return fmt.Sprintf("%s.%x", *csvCache, sum[:4])
+}
+
+// readCsvSource returns the contents of a translated CSV listed in
+// -translatedCsv, downloading it to cachePath if it is a URL.
+func readCsvSource(src, cachePath string) []byte {
+	if isURL(src) {
+		return download(src, cachePath)
+	}
+	data, err := fsys.ReadFile(src)
+	Fatal(err)
+	return data
+}
+
+// loadTLLinesFrom reads a single translated CSV, downloading it first if src
+// is a URL.
+func loadTLLinesFrom(src, cachePath string) []*TLLine {
+	var tlLines []*TLLine
+	// gocsv would read a byte order mark as part of the first column name.
+	data, rows, comments, err := stripCommentRows(bytes.TrimPrefix(readCsvSource(src, cachePath), []byte("\ufeff")))
+	Fatal(err)
+	if err := checkCsvHeader(data); err != nil {
+		Fatal(fmt.Errorf("%s: %v", src, err))
+	}
+	Fatal(gocsv.UnmarshalBytes(data, &tlLines))
+	for i, l := range tlLines {
+		l.Source = src
+		// rows[0] is the header.
+		if i+1 < len(rows) {
+			l.Row = rows[i+1]
+		}
+	}
+	i := 0
+	for _, c := range comments {
+		for i < len(tlLines)-1 && tlLines[i].Row < c.Row {
+			i++
+		}
+		if i < len(tlLines) {
+			tlLines[i].Comments = append(tlLines[i].Comments, c)
+		}
+	}
+	return tlLines
+}
+
+// loadTLLines reads the translated CSVs listed in -translatedCsv, and merges
+// their lines. When several CSVs have a line with the same key, the line
+// from the CSV listed last is used.
+func loadTLLines() []*TLLine {
+	sources := translatedCsvSources()
+	numURLs := 0
+	for _, src := range sources {
+		if isURL(src) {
+			numURLs++
+		}
+	}
+	if len(sources) == 1 {
+		return loadTLLinesFrom(sources[0], csvCachePath(sources[0], numURLs))
+	}
+
+	var tlLines []*TLLine
+	var lineSources []string
+	keySource := make(map[string]string)
+	for _, src := range sources {
+		for _, l := range loadTLLinesFrom(src, csvCachePath(src, numURLs)) {
+			if prev, ok := keySource[l.Key]; ok && l.Key != "" && prev != src {
+				log.Printf("WARNING: %s: the line in %s overrides the line in %s", l.Key, src, prev)
+			}
+			if l.Key != "" {
+				keySource[l.Key] = src
+			}
+			tlLines = append(tlLines, l)
+			lineSources = append(lineSources, src)
+		}
+	}
+
+	merged := tlLines[:0]
+	for i, l := range tlLines {
+		if l.Key == "" || keySource[l.Key] == lineSources[i] {
+			merged = append(merged, l)
+		}
+	}
+	return merged
+}
+
+// stripCommentRows removes comment rows from the translated CSV. A comment
+// row is any row whose first cell starts with "#", such as banners and
+// section separators in the sheet. Comment rows may also come before the
+// header row. rows are the rows of the records that are kept, numbered from 1
+// with the comment rows counted, as in a spreadsheet, and comments are the
+// rows that are removed.
+func stripCommentRows(data []byte) (out []byte, rows []int, comments []csvComment, err error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	for i, record := range records {
+		if len(record) != 0 && strings.HasPrefix(strings.TrimPrefix(record[0], "\ufeff"), "#") {
+			comments = append(comments, csvComment{Row: i + 1, Record: record})
+			continue
+		}
+		if err := w.Write(record); err != nil {
+			return nil, nil, nil, err
+		}
+		rows = append(rows, i+1)
+	}
+	w.Flush()
+	return buf.Bytes(), rows, comments, w.Error()
+}
+
+// requiredColumns are the CSV columns that patch cannot work without.
+var requiredColumns = []string{"KEY", "INDEX", "TRANSLATED_TEXT"}
+
+// csvColumns returns the CSV column names of the fields of TLLine.
+func csvColumns() []string {
+	var columns []string
+	t := reflect.TypeOf(TLLine{})
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("csv"); tag != "" && tag != "-" {
+			columns = append(columns, tag)
+		}
+	}
+	return columns
+}
+
+// checkCsvHeader returns an error if the header row of the translated CSV
+// is missing any required column, since the CSV would otherwise silently be
+// read as having no translations. Unexpected columns are only reported.
+func checkCsvHeader(data []byte) error {
+	header, err := csv.NewReader(bytes.NewReader(data)).Read()
+	if err != nil {
+		return fmt.Errorf("could not read CSV header: %v", err)
+	}
+	found := make(map[string]bool)
+	for i, column := range header {
+		if i == 0 {
+			column = strings.TrimPrefix(column, "\ufeff")
+		}
+		found[strings.TrimSpace(column)] = true
+	}
+
+	var missing, unexpected []string
+	for _, column := range requiredColumns {
+		if !found[column] {
+			missing = append(missing, column)
+		}
+	}
+	known := make(map[string]bool)
+	for _, column := range csvColumns() {
+		known[column] = true
+	}
+	for _, column := range header {
+		if column = strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")); !known[column] {
+			unexpected = append(unexpected, column)
+		}
+	}
+
+	if len(missing) != 0 {
+		return fmt.Errorf("CSV is missing columns %q (unexpected columns: %q)", missing, unexpected)
+	}
+	if len(unexpected) != 0 {
+		log.Printf("WARNING: CSV has unexpected columns %q", unexpected)
+	}
+	return nil
+}
+
+// translation returns the text that should be patched in for l, preferring
+// the edited text over the raw translation. Returns an empty string if the
+// line has no translation.
+func translation(l *TLLine) string {
+	tl := l.TranslatedText
+	if l.EdittedText != "" {
+		tl = l.EdittedText
+	}
+	// A translation that is only a translator note is not translated yet, and
+	// one that already starts with a name, such as one copied from the
+	// English files, keeps it.
+	if l.Speaker != "" && strings.TrimSpace(stripComments(tl)) != "" && !translatedSpeakerRE.MatchString(tl) {
+		tl = l.Speaker + tl
+	}
+	return tl
+}
+
+// speakerRE matches the speaker name at the start of a line of dialog for
+// -speakerColumn. Brackets later in the line, and bracketed text that reads
+// as a sentence rather than a name, are not names.
+var speakerRE = regexp.MustCompile(`^(?:「[^「」。、！？…\n]{1,16}」|【[^【】。、！？…\n]{1,16}】)`)
+
+// translatedSpeakerRE matches the speaker name at the start of a translation,
+// which may also be in [], with the spaces after it.
+var translatedSpeakerRE = regexp.MustCompile(`^(?:「[^「」\n]{1,24}」|【[^【】\n]{1,24}】|\[[^\[\]\n]{1,24}\]) *`)
+
+// splitSpeaker returns the speaker name matched by re at the start of s and
+// the rest of s. Lines that are only a bracketed text, such as a quote, have
+// no speaker.
+func splitSpeaker(re *regexp.Regexp, s string) (speaker, body string) {
+	speaker = re.FindString(s)
+	if speaker == "" || strings.TrimSpace(s[len(speaker):]) == "" {
+		return "", s
+	}
+	return speaker, s[len(speaker):]
+}
+
+// bracketReplacer makes the -bracketReplacements. It is set in main.
+var bracketReplacer *strings.Replacer
+
+// keepBracketsFiles is the set of -keepBracketsFiles. It is set in main.
+var keepBracketsFiles map[string]bool
+
+// parseBracketReplacements returns a replacer for the -bracketReplacements.
+func parseBracketReplacements(s string) *strings.Replacer {
+	var oldnew []string
+	for _, r := range strings.Split(s, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		i := strings.Index(r, "=")
+		if i <= 0 {
+			log.Fatalln("invalid bracketReplacements: ", s)
+		}
+		oldnew = append(oldnew, r[:i], r[i+1:])
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// replaceBrackets replaces the name brackets used in the sheet with the ones
+// the game expects, unless base is one of the -keepBracketsFiles.
+func replaceBrackets(base, s string) string {
+	if bracketReplacer == nil || keepBracketsFiles[base] {
+		return s
+	}
+	return bracketReplacer.Replace(s)
+}
+
+// Substitution is a row of the -substitutions CSV.
+type Substitution struct {
+	From string `csv:"FROM"`
+	To   string `csv:"TO"`
+}
+
+var substitutionReplacer *strings.Replacer
+
+// loadReplacer returns a replacer for the FROM and TO columns of a
+// -substitutions style CSV.
+func loadReplacer(path string) *strings.Replacer {
+	data, err := fsys.ReadFile(path)
+	Fatal(err)
+	var subs []*Substitution
+	Fatal(gocsv.UnmarshalBytes(data, &subs))
+	var oldnew []string
+	for _, sub := range subs {
+		if sub.From == "" {
+			continue
+		}
+		oldnew = append(oldnew, sub.From, sub.To)
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// loadAbbreviations returns a function that makes the abbreviations in the
+// FROM and TO columns of the -abbreviations CSV. Abbreviations only replace
+// whole words, in the order of the CSV, and control codes are left alone.
+func loadAbbreviations(path string) func(s string) string {
+	data, err := fsys.ReadFile(path)
+	Fatal(err)
+	var subs []*Substitution
+	Fatal(gocsv.UnmarshalBytes(data, &subs))
+	var res []*regexp.Regexp
+	var tos []string
+	for _, sub := range subs {
+		if sub.From == "" {
+			continue
+		}
+		res = append(res, regexp.MustCompile(wordExpr(sub.From)))
+		tos = append(tos, sub.To)
+	}
+	abbreviate := func(s string) string {
+		for i, re := range res {
+			s = re.ReplaceAllLiteralString(s, tos[i])
+		}
+		return s
+	}
+	return func(s string) string {
+		var out strings.Builder
+		last := 0
+		for _, m := range controlCodeRE.FindAllStringIndex(s, -1) {
+			out.WriteString(abbreviate(s[last:m[0]]))
+			out.WriteString(s[m[0]:m[1]])
+			last = m[1]
+		}
+		out.WriteString(abbreviate(s[last:]))
+		return out.String()
+	}
+}
+
+// substitute replaces the text in s listed in the -substitutions CSV, which
+// is loaded the first time it is needed.
+func substitute(s string) string {
+	if *substitutionsFile == "" {
+		return s
+	}
+	if substitutionReplacer == nil {
+		substitutionReplacer = loadReplacer(*substitutionsFile)
+	}
+	return substitutionReplacer.Replace(s)
+}
+
+// singleLine reports whether the segment with key is shown on a single line,
+// like the buttons of choices, so that its translation must not contain new
+// lines.
+func singleLine(key string) bool {
+	_, st, _, err := scn.ParseKey(key)
+	return err == nil && (st == scn.ChoiceSegment || st == scn.FileTagSegment)
+}
+
+// transformTLLine returns the translation of l as it will be written to the
+// SCN file, before encoding: translator notes are removed, name brackets and
+// -substitutions are replaced and the text is word wrapped, unless the line
+// is manualStatus. Choices and file tags are kept on a single line. Each
+// element is written as a separate line sharing l's index.
+func transformTLLine(l *TLLine) []string {
+	tl := translation(l)
+	if commentRE != nil {
+		for _, note := range commentRE.FindAllString(tl, -1) {
+			logV("%s: removing translator note %q", l.Key, note)
+		}
+		tl = stripComments(tl)
+	}
+	// Replace name brackets.
+	tl = substitute(replaceBrackets(l.Filename, tl))
+
+	if singleLine(l.Key) {
+		// Choices and file tags are neither wrapped nor split, and any new
+		// lines are replaced with spaces.
+		tl = widthRE.ReplaceAllString(strings.ReplaceAll(removePPNewLines(tl), "\n", " "), "")
+		if *normalizeSpacesFlag && l.LineStatus != manualStatus {
+			tl = normalizeSpaces(tl)
+		}
+		return []string{tl}
+	}
+
+	var parts []string
+	for _, part := range splitMarkerRE.Split(tl, -1) {
+		part = unescapeTildes(part)
+		if l.LineStatus == manualStatus {
+			parts = append(parts, addPPNewLines(widthRE.ReplaceAllString(part, "")))
+			continue
+		}
+		if *normalizeSpacesFlag {
+			part = normalizeSpaces(part)
+		}
+		tlWrapped := wrap(part, wrapWidth(l.Key))
+		// if tl != tlWrapped {
+		// fmt.Printf("%v\n->\n%v\n\n", tl, tlWrapped)
+		// }
+		parts = append(parts, addPPNewLines(tlWrapped))
+	}
+	return parts
+}
+
+// encodeTLLine returns the translation of l as the bytes that are written to
+// the SCN file: name brackets are replaced, the text is word wrapped and
+// encoded with -encoding, and split lines are converted back into line starts.
+func encodeTLLine(l *TLLine) ([]byte, error) {
+	var jis []byte
+	for i, part := range transformTLLine(l) {
+		partJis, err := scn.Encode(part)
+		if err != nil {
+			// Report the position in the translation rather than in the
+			// wrapped part, so that translators can find it.
+			var encErr *scn.EncodeError
+			if errors.As(err, &encErr) {
+				if i := strings.IndexRune(translation(l), encErr.Rune); i != -1 {
+					return nil, fmt.Errorf("character %d of the translation, %q (%U), cannot be encoded", utf8.RuneCountInString(translation(l)[:i])+1, encErr.Rune, encErr.Rune)
+				}
+			}
+			return nil, err
+		}
+		if i > 0 {
+			// Convert the split marker back into split lines.
+			jis = append(jis, lineTerminator())
+			jis = append(jis, scn.LineStart(uint32(l.Index))...)
+		}
+		jis = append(jis, partJis...)
+	}
+	return jis, nil
+}
+
+// countSegments returns the number of segments of type st.
+func countSegments(segs []*scn.Segment, st scn.SegmentType) int {
+	n := 0
+	for _, ss := range segs {
+		if ss.Type == st {
+			n++
+		}
+	}
+	return n
+}
+
+// referencePaths returns the paths of the reference files by base name if
+// -referenceCheck is set.
+func referencePaths() map[string]string {
+	baseToReferencePath := make(map[string]string)
+	if *referenceCheck {
+		referencePaths, err := globScn(*referenceScnFiles)
+		Fatal(err)
+		for _, path := range referencePaths {
+			baseToReferencePath[filepath.Base(path)] = path
+		}
+	}
+	return baseToReferencePath
+}
+
+// writePatched writes a patched SCN file to the output folder, and compares
+// it to the reference file if -referenceCheck is set. If -dedupeOutput is set
+// and the output file already has the same contents it is left untouched.
+// Returns true if the file was written.
+func writePatched(base string, outData []byte, baseToReferencePath map[string]string) bool {
+	outPath := filepath.Join(*outputScnFolder, base)
+	written := true
+	if existing, err := fsys.ReadFile(outPath); *dedupeOutput && err == nil && bytes.Equal(existing, outData) {
+		logV("%s unchanged", base)
+		written = false
+	} else {
+		err := writeFile(outPath, outData)
+		Fatal(err)
+	}
+
+	if *referenceCheck {
+		referencePath := baseToReferencePath[base]
+		refData, err := readScn(referencePath)
+		Fatal(err)
+		compare := bytes.Compare(refData, outData)
+		if compare != 0 {
+			log.Printf("mismatch during reference check of %s: %s", base, referencePath)
+		}
+	}
+	return written
+}
+
+// dryRunLines returns the original and patched text of every line of the SCN
+// file base that patching replaces, decoded from the original and patched
+// files, so that it shows exactly what is written, wrapping included. The
+// lines of a translation that are split over several lines with the same
+// index are separated by -splitMarker.
+func dryRunLines(base string, original, patched []byte) string {
+	decoded := func(data []byte) ([]string, map[string][]string, error) {
+		// Patch already warned about the problems it allows.
+		p := parser()
+		split, err := p.SplitFile(data)
+		if err != nil && !errors.Is(err, scn.ErrMissingLineIndex) && !(errors.Is(err, scn.ErrLossyParse) && *allowLossyParse) {
+			return nil, nil, err
+		}
+		var keys []string
+		texts := make(map[string][]string)
+		for _, ss := range split {
+			if ss.Type == "" {
+				continue
+			}
+			key := scn.Key(base, ss.Type, ss.Index)
+			if _, ok := texts[key]; !ok {
+				keys = append(keys, key)
+			}
+			texts[key] = append(texts[key], scn.Decode(ss.Data))
+		}
+		return keys, texts, nil
+	}
+	keys, before, err := decoded(original)
+	if err != nil {
+		log.Printf("WARNING: %s: could not parse the original file: %v", base, err)
+		return ""
+	}
+	_, after, err := decoded(patched)
+	if err != nil {
+		log.Printf("WARNING: %s: could not parse the patched file: %v", base, err)
+		return ""
+	}
+
+	// indent puts each part of a line on lines of their own, with the game's
+	// line breaks as new lines.
+	indent := func(parts []string) string {
+		text := strings.Join(parts, "\n"+*splitMarker+"\n")
+		return strings.ReplaceAll(removePPNewLines(text), "\n", "\n   ")
+	}
+	var out strings.Builder
+	for _, key := range keys {
+		if strings.Join(before[key], "\x00") == strings.Join(after[key], "\x00") {
+			continue
+		}
+		if out.Len() == 0 {
+			out.WriteString(fmt.Sprintf("==== %s ====\n", base))
+		}
+		out.WriteString(fmt.Sprintf("-- %s\n   %s\n=> %s\n", key, indent(before[key]), indent(after[key])))
+	}
+	if out.Len() != 0 {
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+// patchReport collects the result of patching a file, and the warnings found
+// while doing so. Problems that are fatal in normal mode are only collected
+// in atomic mode. Warnings are logged once all files have been patched, in
+// file order.
+type patchReport struct {
+	base string
+	// data is the patched file, or nil if the file was skipped.
+	data []byte
+	// original is the file before patching, kept for -dryRun.
+	original []byte
+	patched  bool
+	matched  []string
+	warnings []*scn.Warning
+	problems int
+	// tooLong is the number of lines too long for strict size mode.
+	tooLong int
+	// shrunk are the keys of the lines -abbreviations made fit.
+	shrunk []string
+	// entry describes the patched file in manifest.json.
+	entry ManifestEntry
+}
+
+// ManifestEntry describes a file written by patch in manifest.json, so that
+// builds can check the patched files.
+type ManifestEntry struct {
+	File             string `json:"file"`
+	Size             int    `json:"size"`
+	StrictSize       bool   `json:"strictSize"`
+	LinesReplaced    int    `json:"linesReplaced"`
+	BubblesRemoved   bool   `json:"bubblesRemoved"`
+	RouteChangeFixed bool   `json:"routeChangeFixed"`
+}
+
+func (r *patchReport) warn(w *scn.Warning) {
+	r.warnings = append(r.warnings, w)
+}
+
+// problem records a warning that stops an atomic patch from writing files.
+func (r *patchReport) problem(w *scn.Warning) {
+	r.warn(w)
+	r.problems++
+}
+
+// fail records a problem that is fatal unless -atomic is set.
+func (r *patchReport) fail(w *scn.Warning) {
+	if !*atomic {
+		log.Fatal(w)
+	}
+	r.problem(w)
+}
+
+// parallel calls f for every i in [0, n) on -workers goroutines.
+func parallel(n int, f func(i int)) {
+	workers := *workersFlag
+	if workers < 1 {
+		workers = 1
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// progressLine shows how many of the files a mode has processed on one line
+// of stderr, which is rewritten as files are done. It is only shown if stderr
+// is a terminal, and not with -quiet or -verbose, whose log would break it up.
+type progressLine struct {
+	mu      sync.Mutex
+	verb    string
+	done    int
+	total   int
+	enabled bool
+}
+
+func newProgressLine(verb string, total int) *progressLine {
+	p := &progressLine{verb: verb, total: total}
+	if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		p.enabled = !*quiet && !*verbose
+	}
+	return p
+}
+
+// step records that a file is done.
+func (p *progressLine) step() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if p.enabled {
+		fmt.Fprintf(os.Stderr, "\r%s %d/%d files...", p.verb, p.done, p.total)
+	}
+}
+
+// finish clears the line, so that the log continues where it started.
+func (p *progressLine) finish() {
+	if p.enabled && p.done != 0 {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
+
+func patch() {
+	switch *inputFormat {
+	case "csv":
+	case "json-segments":
+		patchJSONSegments()
+		return
+	default:
+		log.Fatalln("invalid inputFormat: ", *inputFormat)
+	}
+	// log.Println("output scn directory: ", *outputScnFolder)
+	tlLines := loadTLLines()
+
+	// Every warning is written to warnings.csv. Problems are counted so that
+	// in atomic mode no file is written unless there were none.
+	var warnings []*scn.Warning
+	problems := 0
+	report := func(r *patchReport) {
+		for _, w := range r.warnings {
+			log.Print("WARNING: ", w)
+		}
+		warnings = append(warnings, r.warnings...)
+		problems += r.problems
+	}
+
+	lineReport := &patchReport{}
+	lineMap := make(map[string][]byte)
+	// keyLines maps keys to the line they were first translated in.
+	keyLines := make(map[string]*TLLine)
+	// keyText is the translation of each key, used to report translations
+	// that are never applied.
+	keyText := make(map[string]string)
+	duplicates := 0
+	for _, l := range tlLines {
+		// log.Println("processing TL line: ", l)
+		// A translation that is only a translator note is not translated yet.
+		if strings.TrimSpace(stripComments(translation(l))) == "" || l.Key == "" {
+			// A blank choice keeps its original text, but a choice whose
+			// translation is only a note was meant to be translated. Choices
+			// translated as only control codes are reported by Check.
+			if _, st, _, err := scn.ParseKey(l.Key); err == nil && st == scn.ChoiceSegment && strings.TrimSpace(translation(l)) != "" {
+				w := &scn.Warning{File: l.Filename, Key: l.Key, Reason: fmt.Sprintf("choice is translated as %q, which is empty once translator notes are removed, leaving it untranslated", translation(l))}
+				if *emptyChoiceError {
+					lineReport.fail(w)
+				} else {
+					lineReport.warn(w)
+				}
+			}
+			continue
+		}
+		if first, ok := keyLines[l.Key]; ok {
+			reason := fmt.Sprintf("duplicate key in %s and %s, using %s", first.location(), l.location(), l.location())
+			if first.Source == l.Source {
+				reason = fmt.Sprintf("duplicate key in %s rows %d and %d, using row %d", l.Source, first.Row, l.Row, l.Row)
+			}
+			lineReport.warn(&scn.Warning{File: l.Filename, Key: l.Key, Reason: reason})
+			duplicates++
+		} else {
+			keyLines[l.Key] = l
+		}
+		jis, err := encodeTLLine(l)
+		if err != nil {
+			lineReport.problem(&scn.Warning{File: l.Filename, Key: l.Key, Reason: fmt.Sprintf("skipping line: %v", err)})
+			continue
+		}
+		lineMap[l.Key] = jis
+		keyText[l.Key] = translation(l)
+		if singleLine(l.Key) && strings.Contains(removePPNewLines(translation(l)), "\n") {
+			lineReport.warn(&scn.Warning{File: l.Filename, Key: l.Key, Reason: "new lines are replaced with spaces, since the line is shown on a single line"})
+		}
+		if *checkColorsFlag {
+			if open := openColorLines(transformTLLine(l)); len(open) != 0 {
+				lineReport.warn(&scn.Warning{Key: l.Key, Reason: fmt.Sprintf("color is not reset at the end of wrapped line(s) %v", open)})
+			}
+		}
+		if *maxLines > 0 && !singleLine(l.Key) {
+			if n := boxLines(transformTLLine(l)); n > *maxLines {
+				w := &scn.Warning{File: l.Filename, Key: l.Key, TranslatedLength: len(jis), Reason: fmt.Sprintf("translation is %d lines after wrapping, but the text box only shows %d", n, *maxLines)}
+				if *wrapStrict {
+					lineReport.fail(w)
+				} else {
+					lineReport.warn(w)
+				}
+			}
+		}
+	}
+	report(lineReport)
+	if *failOnDuplicateKeys && duplicates != 0 {
+		log.Fatalf("found %d duplicate keys in the translated csv", duplicates)
+	}
+
+	baseToReferencePath := referencePaths()
+
+	switch *lockMode {
+	case "copy", "error":
+	default:
+		log.Fatalln("invalid lockMode: ", *lockMode)
+	}
+	lockedFiles := splitList(*lockFilesFlag)
+	keepBubblesFiles := splitList(*keepBubblesFlag)
+	routeChangeFiles := splitList(*routeChangeFlag)
+	padding := paddingBytes()
+	hashes := loadHashes()
+	var shrink func(base string, ss *scn.Segment, line []byte) []byte
+	if *abbreviationsFile != "" {
+		abbreviate := loadAbbreviations(*abbreviationsFile)
+		shrink = func(base string, ss *scn.Segment, line []byte) []byte {
+			short, err := scn.Encode(abbreviate(scn.Decode(line)))
+			if err != nil {
+				return nil
+			}
+			return short
+		}
+	}
+
+	// patchFile patches a single file. It is called concurrently, so it only
+	// reads the shared state and collects its warnings in its report.
+	patchFile := func(path string) *patchReport {
+		r := &patchReport{base: filepath.Base(path)}
+		base := r.base
+		data, err := readScn(path)
+		Fatal(err)
+		if *dryRun {
+			r.original = data
+		}
+		if hashes != nil {
+			if want, ok := hashes[base]; !ok {
+				r.warn(&scn.Warning{File: base, Reason: "not in -verifyHashes"})
+			} else if got := sha256Hex(data); got != want {
+				w := &scn.Warning{File: base, Reason: fmt.Sprintf("SHA-256 hash %s does not match %s in -verifyHashes, the file may be from another version of the game", got, want)}
+				if *hashMismatch == "error" {
+					r.fail(w)
+				} else {
+					r.warn(w)
+				}
+			}
+		}
+		if lockedFiles[base] && *lockMode == "copy" {
+			logV("%s is locked, copying it unchanged", base)
+			r.data = data
+			return r
+		}
+		// A locked file in error mode is only patched to check that none of
+		// its translations would change it, so the speech bubbles and the FOTS
+		// fixes are left alone.
+		locked := lockedFiles[base]
+
+		patcher := &scn.Patcher{
+			Parser:           parser(),
+			AllowLossyParse:  *allowLossyParse,
+			Lines:            lineMap,
+			StrictSize:       strictSizeMode,
+			Padding:          padding,
+			Shrink:           shrink,
+			RouteChangeFiles: routeChangeFiles,
+			SkipFOTSPatches:  locked,
+			KeepBubbles: func(base string) bool {
+				return *keepBubbles || keepBubblesFiles[base] || locked
+			},
+			Untranslated: func(base string, ss *scn.Segment) []byte {
+				if *markUntranslated == "" || locked {
+					return nil
+				}
+				return untranslatedMarker(base, ss)
+			},
+			Transform: func(base string, ss *scn.Segment, line []byte) []byte {
+				if ss.Type != scn.TextSegment {
+					return line
+				}
+				key := scn.Key(base, ss.Type, ss.Index)
+				tagged := keepVoiceTag(key, ss.Data, line)
+				// A translation that fits in strict size mode is not made too
+				// long by the voice tag.
+				if strictSizeMode(base) && len(line) <= len(ss.Data) && len(tagged) > len(ss.Data) {
+					r.warn(&scn.Warning{File: base, Key: key, OriginalLength: len(ss.Data), TranslatedLength: len(tagged), Reason: fmt.Sprintf("the voice tag of the original does not fit in %v bytes in strict size mode, leaving it out", len(ss.Data))})
+					return line
+				}
+				return tagged
+			},
+			Check: func(base string, ss *scn.Segment, eng []byte) bool {
+				lineWarning := func(format string, v ...interface{}) *scn.Warning {
+					return &scn.Warning{File: base, Key: scn.Key(base, ss.Type, ss.Index), OriginalLength: len(ss.Data), TranslatedLength: len(eng), Reason: fmt.Sprintf(format, v...)}
+				}
+				if ss.Type == scn.ChoiceSegment && len(ss.Data) != 0 && strings.TrimSpace(stripControlCodes(scn.Decode(eng))) == "" {
+					w := lineWarning("choice %q is translated as empty text %q", scn.Decode(ss.Data), scn.Decode(eng))
+					if *emptyChoiceError {
+						r.fail(w)
+					} else {
+						r.warn(w)
+					}
+				}
+				if ss.Type == scn.ChoiceSegment && *maxChoiceWidth > 0 {
+					if width := displayWidth(scn.Decode(eng)); width > *maxChoiceWidth {
+						w := lineWarning("choice %q (width: %v) is wider than %v", scn.Decode(eng), width, *maxChoiceWidth)
+						if *wrapStrict {
+							r.fail(w)
+						} else {
+							r.warn(w)
+						}
+					}
+				}
+				if !strictSizeMode(base) && *segmentCapBytes >= 0 && len(eng)-len(ss.Data) > *segmentCapBytes {
+					r.warn(lineWarning("Translation line %q (len: %v) is more than %v bytes longer than line %q (len: %v) and may overflow the line buffer", eng, len(eng), *segmentCapBytes, scn.Decode(ss.Data), len(ss.Data)))
+				}
+				if locked && !bytes.Equal(eng, ss.Data) {
+					r.fail(lineWarning("%s is locked, but the translation would change it", base))
+					return false
+				}
+				return true
+			},
+			Warn:   r.problem,
+			Debugf: logV,
+		}
+
+		res, err := patcher.Patch(base, data)
+		if err != nil {
+			r.problem(&scn.Warning{File: base, Reason: fmt.Sprintf("skipping file: %v", explainParseError(err))})
+			return r
+		}
+		if locked && !bytes.Equal(res.Data, data) {
+			r.fail(&scn.Warning{File: base, Reason: fmt.Sprintf("%s is locked, but patching would change it, copying it unchanged", base)})
+			res.Data = data
+		}
+		r.patched = true
+		r.tooLong = res.LinesTooLong
+		r.shrunk = res.Shrunk
+		r.entry = ManifestEntry{
+			StrictSize:       res.StrictSize,
+			LinesReplaced:    res.LinesReplaced,
+			BubblesRemoved:   res.BubblesRemoved,
+			RouteChangeFixed: res.RouteChangeFixed,
+		}
+		for _, ss := range res.Segments {
+			if ss.Type != "" {
+				r.matched = append(r.matched, scn.Key(base, ss.Type, ss.Index))
+			}
+		}
+		outData := res.Data
+		p := parser()
+		outSplit, err := p.SplitFile(outData)
+		if isParseWarning(err) {
+			// Patch has already reported these problems of the original file.
+			err = nil
+		}
+		if err != nil {
+			r.problem(&scn.Warning{File: base, Reason: fmt.Sprintf("patched file: %v", explainParseError(err))})
+		} else {
+			logV("%s segments:\n %v", base, formatSegments(outSplit))
+			if *atomic {
+				for _, st := range []scn.SegmentType{scn.ChoiceSegment, scn.FileTagSegment} {
+					if before, after := countSegments(res.Segments, st), countSegments(outSplit, st); before != after {
+						r.problem(&scn.Warning{File: base, Reason: fmt.Sprintf("patched file has %v %s segments, but the original has %v", after, st, before)})
+					}
+				}
+			}
+		}
+		r.data = outData
+		return r
+	}
+
+	paths, err := globScn(*scnFileFlag)
+	Fatal(err)
+	// log.Println("processing original files: ", paths)
+	reports := make([]*patchReport, len(paths))
+	progress := newProgressLine("patching", len(paths))
+	parallel(len(paths), func(i int) {
+		reports[i] = patchFile(paths[i])
+		progress.step()
+	})
+	progress.finish()
+
+	// matched records the keys of lineMap found in the patched files, so that
+	// translations whose key matches no line can be reported.
+	inputs := make(map[string]bool)
+	for _, path := range paths {
+		inputs[filepath.Base(path)] = true
+	}
+	patched := make(map[string]bool)
+	matched := make(map[string]bool)
+	var pending []*patchReport
+	// written and unchanged count the patched files that were written, and
+	// those left untouched by -dedupeOutput.
+	written, unchanged := 0, 0
+	writeReport := func(r *patchReport) {
+		if writePatched(r.base, r.data, baseToReferencePath) {
+			written++
+		} else {
+			unchanged++
+		}
+	}
+	tooLong := 0
+	var shrunk []string
+	for _, r := range reports {
+		report(r)
+		tooLong += r.tooLong
+		shrunk = append(shrunk, r.shrunk...)
+		if r.patched {
+			patched[r.base] = true
+		}
+		for _, key := range r.matched {
+			matched[key] = true
+		}
+		if r.data == nil {
+			continue
+		}
+		if *dryRun {
+			fmt.Print(dryRunLines(r.base, r.original, r.data))
+			continue
+		}
+		if *atomic {
+			pending = append(pending, r)
+			continue
+		}
+		writeReport(r)
+	}
+
+	var keys []string
+	for key := range lineMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	keyReport := &patchReport{}
+	// missingFiles counts the translations of files that do not match
+	// -scnFiles, which are reported once per file.
+	missingFiles := make(map[string]int)
+	var missingBases []string
+	for _, key := range keys {
+		base, _, _, err := scn.ParseKey(key)
+		switch {
+		case err != nil:
+			keyReport.warn(&scn.Warning{Key: key, Reason: err.Error()})
+		case !inputs[base]:
+			if missingFiles[base] == 0 {
+				missingBases = append(missingBases, base)
 			}
+			missingFiles[base]++
+		case patched[base] && !matched[key]:
+			keyReport.warn(&scn.Warning{File: base, Key: key, TranslatedLength: len(lineMap[key]), Reason: fmt.Sprintf("no line in the file has this key, translation %q is not used", keyText[key])})
+		}
+	}
+	for _, base := range missingBases {
+		keyReport.warn(&scn.Warning{File: base, Reason: fmt.Sprintf("%d translated lines are not used, no file matching -scnFiles has this name", missingFiles[base])})
+	}
+	report(keyReport)
+	if len(shrunk) != 0 {
+		log.Printf("shortened %d lines with -abbreviations to fit strict size mode: %s", len(shrunk), strings.Join(shrunk, ", "))
+	}
+	if tooLong != 0 {
+		log.Printf("WARNING: %d lines are left untranslated because they are too long for strict size mode", tooLong)
+	}
+
+	if *dryRun {
+		log.Printf("dry run, no files were written")
+		return
+	}
+
+	warningsCsv, err := gocsv.MarshalBytes(warnings)
+	Fatal(err)
+	Fatal(writeFile(filepath.Join(*outputFolder, "warnings.csv"), warningsCsv))
+
+	if *atomic {
+		if problems != 0 {
+			log.Fatalf("atomic patch found %d problems, no files were written", problems)
+		}
+		for _, r := range pending {
+			writeReport(r)
+		}
+	}
+	if unchanged != 0 {
+		log.Printf("wrote %d patched files, %d were unchanged", written, unchanged)
+	} else {
+		log.Printf("wrote %d patched files", written)
+	}
+
+	manifest := []ManifestEntry{}
+	for _, r := range reports {
+		if r.data != nil {
+			r.entry.File = r.base
+			r.entry.Size = len(r.data)
+			manifest = append(manifest, r.entry)
+		}
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	Fatal(err)
+	Fatal(writeFile(filepath.Join(*outputFolder, "manifest.json"), manifestJSON))
+}
+
+// textEncodings are the values of -encoding.
+var textEncodings = map[string]encoding.Encoding{
+	"shiftjis": japanese.ShiftJIS,
+	"eucjp":    japanese.EUCJP,
+	"utf8":     unicode.UTF8,
+}
+
+// setup checks the flags shared by the modes and sets the package state
+// derived from them. main calls it once the flags are parsed.
+func setup() {
+	enc, ok := textEncodings[*encodingFlag]
+	if !ok {
+		log.Fatalln("invalid encoding: ", *encodingFlag)
+	}
+	scn.TextEncoding = enc
+	switch *wrapMeasure {
+	case "width", "bytes":
+	default:
+		log.Fatalln("invalid wrapMeasure: ", *wrapMeasure)
+	}
+	if *splitMarker == "" || strings.ContainsAny(*splitMarker, "\r\n") {
+		log.Fatalln("invalid splitMarker: ", *splitMarker)
+	}
+	bracketReplacer = parseBracketReplacements(*bracketsFlag)
+	keepBracketsFiles = splitList(*keepBracketsFlag)
+	strictSizeFiles = splitList(*strictSizeFlag)
+	pageBreakRE = nil
+	if *pageBreak != "" {
+		pageBreakRE = regexp.MustCompile(` *` + regexp.QuoteMeta(*pageBreak) + ` *`)
+	}
+	splitMarkerRE = regexp.MustCompile(`(?:\n|\\N)` + regexp.QuoteMeta(*splitMarker) + `(?:\n|\\N)`)
+	commentRE = nil
+	if *commentStart != "" {
+		if *commentEnd == "" {
+			log.Fatalln("invalid commentEnd: ", *commentEnd)
 		}
+		commentRE = regexp.MustCompile(`(?s)` + regexp.QuoteMeta(*commentStart) + `.*?` + regexp.QuoteMeta(*commentEnd))
 	}
 }
 
 func main() {
 	flag.Parse()
+	setup()
 
 	switch *modeFlag {
 	case "extract":
 		extract()
 	case "patch":
 		patch()
+	case "unsafe-glyphs":
+		unsafeGlyphs()
+	case "glue":
+		glue()
+	case "length-ratio":
+		lengthRatio()
+	case "bilingual":
+		bilingual()
+	case "validate":
+		validate()
+	case "encode-table":
+		encodeTable()
+	case "preview-diff":
+		previewDiff()
+	case "sheet":
+		sheet()
+	case "unchanged-eng":
+		unchangedEng()
+	case "choice-offsets":
+		choiceOffsets()
+	case "tmx":
+		exportTMX()
+	case "corpus":
+		corpus()
+	case "diff":
+		diff()
+	case "dump":
+		dump()
+	case "stats":
+		stats()
+	case "roundtrip":
+		roundTrip()
+	case "verify-encoding":
+		verifyEncoding()
+	case "keys":
+		keys()
+	case "reverse":
+		reverse()
+	case "hash":
+		hash()
+	case "csvlint":
+		csvLint()
 	default:
 		log.Fatalln("invalid mode: ", *modeFlag)
 	}
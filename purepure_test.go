@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/biribiribiri/purepure/scn"
+)
+
+// mustEncode returns s encoded in scn.TextEncoding.
+func mustEncode(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := scn.Encode(s)
+	if err != nil {
+		t.Fatalf("Encode(%q): %v", s, err)
+	}
+	return b
+}
+
+func TestKeepVoiceTag(t *testing.T) {
+	for _, tc := range []struct {
+		name, orig, line, want string
+	}{
+		{"no tag", "こんにちは", "Hello", "Hello"},
+		{"ascii tag", `こんにちは\V"v001"`, "Hello", `Hello\V"v001"`},
+		{"tag with spaces after", `こんにちは\V"v001" `, "Hello", `Hello\V"v001" `},
+		{"non-ascii tag", `こんにちは\V"声01"`, "Hello", `Hello\V"声01"`},
+		{"translation has its own tag", `こんにちは\V"v001"`, `Hello\V"v002"`, `Hello\V"v002"`},
+		{"tag not at the end", `\V"v001"こんにちは`, "Hello", "Hello"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := keepVoiceTag("key", mustEncode(t, tc.orig), mustEncode(t, tc.line))
+			if want := mustEncode(t, tc.want); !bytes.Equal(got, want) {
+				t.Errorf("keepVoiceTag(%q, %q) = %q, want %q", tc.orig, tc.line, scn.Decode(got), tc.want)
+			}
+		})
+	}
+}
+
+func TestTransformTLLineSplitMarker(t *testing.T) {
+	setFlags(t, map[string]string{"wordwrap": "50"})
+	for _, tc := range []struct {
+		name, tl string
+		want     []string
+	}{
+		{"no marker", "Hello", []string{"Hello"}},
+		{"marker on its own line", "Hello\n~~~~\nBye", []string{"Hello", "Bye"}},
+		{"marker between new line indicators", `Hello\N~~~~\NBye`, []string{"Hello", "Bye"}},
+		{"escaped marker", "Hello\n\\~~~~\nBye", []string{`Hello\N~~~~\NBye`}},
+		{"tildes in the text", "La la~~~~ la", []string{"La la~~~~ la"}},
+		{"marker at the end", "Hello\n~~~~", []string{`Hello\N~~~~`}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := &TLLine{Filename: "1_1_1.scn", Key: "1_1_1.scn-text-0", TranslatedText: tc.tl}
+			if got := transformTLLine(l); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("transformTLLine(%q) = %q, want %q", tc.tl, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	setFlags(t, nil)
+	for _, tc := range []struct {
+		name, s, want string
+	}{
+		{"fits", "Hello you", "Hello you"},
+		{"wrapped", "Hello there friend", "Hello\nthere\nfriend"},
+		{"trailing voice tag", `Hello there friend \V"v001"`, "Hello\nthere\nfriend \\V\"v001\""},
+		{"trailing voice tag without a space", `Hello there friend\V"v001"`, "Hello\nthere\nfriend\\V\"v001\""},
+		{"trailing color code", `Hello there friend \c12`, "Hello\nthere\nfriend \\c12"},
+		{"trailing voice tag on each line", "Hello there friend \\V\"v001\"\nBye \\V\"v002\"", "Hello\nthere\nfriend \\V\"v001\"\nBye \\V\"v002\""},
+		{"voice tag alone", `\V"v001"`, `\V"v001"`},
+		{"voice tag with a space", `Hello \V"v 001" there friend`, "Hello \\V\"v 001\"\nthere\nfriend"},
+		{"trailing voice tag with spaces", `Hello there my\V"voice file 1"`, "Hello\nthere my\\V\"voice file 1\""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := wrap(tc.s, 10); got != tc.want {
+				t.Errorf("wrap(%q, 10) = %q, want %q", tc.s, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWrapChars(t *testing.T) {
+	setFlags(t, nil)
+	for _, tc := range []struct {
+		name, s, want string
+	}{
+		{"fits", "あいうえお", "あいうえお"},
+		{"wrapped", "あいうえおかきくけこ", "あいうえお\nかきくけこ"},
+		{"voice tag with a space", `あいうえお\V"v 001"かきくけこ`, "あいうえお\\V\"v 001\"\nかきくけこ"},
+		{"color code", `あいう\c12えおかき`, "あいう\\c12えお\nかき"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := wrapChars(tc.s, 10); got != tc.want {
+				t.Errorf("wrapChars(%q, 10) = %q, want %q", tc.s, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWrapPageBreak(t *testing.T) {
+	setFlags(t, map[string]string{"pageBreak": `\p`})
+	for _, tc := range []struct {
+		name, s, want string
+	}{
+		{"page break", `aaaa \p bbbb`, `aaaa \p bbbb`},
+		{"wrapped before the page break", `aaaa bbbb cccc \p dddd`, "aaaa bbbb\ncccc \\p dddd"},
+		{"wrapped after the page break", `aaaa \p bbbb cccc dddd`, "aaaa \\p bbbb cccc\ndddd"},
+		{"wrapped on both sides", `aaaa bbbb cccc \p dddd eeee ffff`, "aaaa bbbb\ncccc \\p dddd eeee\nffff"},
+		{"width directive after the page break", `aaaa \p \w4bbbb cccc`, "aaaa \\p bbbb\ncccc"},
+		{"width directive holds after the page break", `\w4aaaa \p bbbb cccc`, "aaaa \\p bbbb\ncccc"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := wrap(tc.s, 10); got != tc.want {
+				t.Errorf("wrap(%q, 10) = %q, want %q", tc.s, got, tc.want)
+			}
+		})
+	}
+	if got, want := boxLines([]string{`aaaa\Nbbbb \p cccc`, "dddd"}), 2; got != want {
+		t.Errorf("boxLines = %d, want %d", got, want)
+	}
+}
+
+func TestReplaceBrackets(t *testing.T) {
+	const s = "【太郎】Hello"
+	for _, tc := range []struct {
+		name  string
+		flags map[string]string
+		base  string
+		want  string
+	}{
+		{"default", nil, "1_1_1.scn", "「太郎」Hello"},
+		{"disabled", map[string]string{"bracketReplacements": ""}, "1_1_1.scn", s},
+		{"kept in the file", map[string]string{"keepBracketsFiles": "1_1_1.scn,1_1_2.scn"}, "1_1_1.scn", s},
+		{"kept in another file", map[string]string{"keepBracketsFiles": "1_1_2.scn"}, "1_1_1.scn", "「太郎」Hello"},
+		{"table", map[string]string{"bracketReplacements": "【=[, 】=]"}, "1_1_1.scn", "[太郎]Hello"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setFlags(t, tc.flags)
+			if got := replaceBrackets(tc.base, s); got != tc.want {
+				t.Errorf("replaceBrackets(%q, %q) = %q, want %q", tc.base, s, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "substitutions.csv")
+	useMemFS(t, map[string][]byte{path: []byte("FROM,TO\nTaro,Tarou\n...,…\n,ignored\n")})
+	setFlags(t, map[string]string{"substitutions": path})
+	substitutionReplacer = nil
+	t.Cleanup(func() { substitutionReplacer = nil })
+	for _, tc := range []struct {
+		s, want string
+	}{
+		{"Hello", "Hello"},
+		{"Taro...", "Tarou…"},
+		{"Taro and Taro", "Tarou and Tarou"},
+	} {
+		if got := substitute(tc.s); got != tc.want {
+			t.Errorf("substitute(%q) = %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestLoadTLLinesRows(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "tl.csv")
+	csv := "\ufeff# banner\n" +
+		"KEY,INDEX,TRANSLATED_TEXT\n" +
+		"1_1_1.scn-text-0,0,\"Hello\nthere\"\n" +
+		"# section\n" +
+		"1_1_1.scn-text-1,1,Bye\n" +
+		"1_1_1.scn-text-0,0,Hi\n"
+	useMemFS(t, map[string][]byte{src: []byte(csv)})
+	setFlags(t, nil)
+
+	var got []int
+	for _, l := range loadTLLinesFrom(src, "") {
+		if l.Source != src {
+			t.Errorf("%s: Source = %q, want %q", l.Key, l.Source, src)
+		}
+		got = append(got, l.Row)
+	}
+	if want := []int{3, 5, 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rows = %v, want %v", got, want)
+	}
+	// csv-lint numbers the rows the same way.
+	_, problems := lintCsv([]byte(csv))
+	if want := []string{`row 6: KEY "1_1_1.scn-text-0" is also on row 3`}; !reflect.DeepEqual(problems, want) {
+		t.Errorf("lintCsv = %q, want %q", problems, want)
+	}
+}
+
+func TestLoadAbbreviations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "abbreviations.csv")
+	useMemFS(t, map[string][]byte{path: []byte("FROM,TO\nand,&\nthe,\nSt.,St\n")})
+	abbreviate := loadAbbreviations(path)
+	for _, tc := range []struct {
+		s, want string
+	}{
+		{"you and me", "you & me"},
+		{"and then", "& then"},
+		{"hand, understand and Sandy", "hand, understand & Sandy"},
+		{"And", "And"},
+		{"in the end", "in  end"},
+		{"theme", "theme"},
+		{"St. Mary", "St Mary"},
+		{`and\Nand`, `&\N&`},
+		{`\V"and the"and`, `\V"and the"&`},
+	} {
+		if got := abbreviate(tc.s); got != tc.want {
+			t.Errorf("abbreviate(%q) = %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
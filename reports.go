@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/biribiribiri/purepure/scn"
+	"github.com/gocarina/gocsv"
+	"golang.org/x/text/width"
+)
+
+var (
+	glyphFile      = flag.String("glyphFile", "", "file containing every glyph supported by the font (for unsafe-glyphs mode)")
+	minLengthRatio = flag.Float64("minLengthRatio", 0.5, "translations narrower than this fraction of the original are reported in length-ratio mode")
+	maxLengthRatio = flag.Float64("maxLengthRatio", 2, "translations wider than this multiple of the original are reported in length-ratio mode")
+)
+
+// loadGlyphs returns the set of runes contained in path. Whitespace is
+// ignored so the file can be formatted freely.
+func loadGlyphs(path string) map[rune]bool {
+	data, err := fsys.ReadFile(path)
+	Fatal(err)
+	glyphs := make(map[rune]bool)
+	for _, r := range string(data) {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		glyphs[r] = true
+	}
+	return glyphs
+}
+
+// unsafeGlyphs reports every translated line that contains a character that
+// is not in the glyph file, and would therefore render as a blank box.
+func unsafeGlyphs() {
+	if *glyphFile == "" {
+		Fatal(fmt.Errorf("unsafe-glyphs mode requires -glyphFile"))
+	}
+	glyphs := loadGlyphs(*glyphFile)
+
+	for _, l := range loadTLLines() {
+		if translation(l) == "" || l.Key == "" {
+			continue
+		}
+		if missing := missingGlyphs(glyphs, l); len(missing) != 0 {
+			fmt.Printf("%s: %s\n", l.Key, strings.Join(missing, " "))
+		}
+	}
+}
+
+// missingGlyphs returns the characters of the translation of l, as patch
+// writes it, that are not in glyphs. Translator notes, split markers, new
+// line indicators and control codes are not rendered, so they are skipped.
+func missingGlyphs(glyphs map[rune]bool, l *TLLine) []string {
+	var missing []string
+	seen := make(map[rune]bool)
+	for _, part := range transformTLLine(l) {
+		for _, r := range stripControlCodes(removePPNewLines(part)) {
+			if r == ' ' || r == '\n' || glyphs[r] || seen[r] {
+				continue
+			}
+			seen[r] = true
+			missing = append(missing, string(r))
+		}
+	}
+	return missing
+}
+
+// displayWidth returns the number of half-width columns s takes up when
+// rendered, counting full-width characters as two columns. Control codes and
+// new lines are not counted.
+func displayWidth(s string) int {
+	w := 0
+	for _, r := range stripControlCodes(removePPNewLines(s)) {
+		switch {
+		case r == '\n':
+		case width.LookupRune(r).Kind() == width.EastAsianWide, width.LookupRune(r).Kind() == width.EastAsianFullwidth:
+			w += 2
+		default:
+			w++
+		}
+	}
+	return w
+}
+
+// lengthRatio reports translations whose display width is suspiciously
+// short or long compared to the original text, which often means the line
+// was truncated or padded.
+func lengthRatio() {
+	originals := readLines(*scnFileFlag)
+
+	for _, l := range loadTLLines() {
+		tl := translation(l)
+		orig, ok := originals[l.Key]
+		if tl == "" || !ok || displayWidth(orig) == 0 {
+			continue
+		}
+		ratio := float64(displayWidth(tl)) / float64(displayWidth(orig))
+		if ratio < *minLengthRatio || ratio > *maxLengthRatio {
+			fmt.Printf("%s: ratio %.2f\n  original:    %q\n  translation: %q\n", l.Key, ratio, orig, tl)
+		}
+	}
+}
+
+// EncodeTableLine is a row of the encode table report.
+type EncodeTableLine struct {
+	Filename         string `csv:"FILENAME"`
+	Key              string `csv:"KEY"`
+	OriginalLength   int    `csv:"ORIGINAL_LENGTH"`
+	TranslatedLength int    `csv:"TRANSLATED_LENGTH"`
+	Headroom         int    `csv:"HEADROOM"`
+}
+
+// encodeTable writes encode_table.csv, listing the original and encoded
+// translation byte lengths of every translated line in the SCN files, with
+// the lines that have the least room first.
+func encodeTable() {
+	paths, err := globScn(*scnFileFlag)
+	Fatal(err)
+	files := make(map[string]bool)
+	for _, path := range paths {
+		files[filepath.Base(path)] = true
+	}
+
+	var rows []*EncodeTableLine
+	for _, l := range loadTLLines() {
+		if translation(l) == "" || l.Key == "" || !files[l.Filename] {
+			continue
+		}
+		jis, err := encodeTLLine(l)
+		if err != nil {
+			log.Printf("WARNING: %s: %v", l.Key, err)
+			continue
+		}
+		rows = append(rows, &EncodeTableLine{
+			Filename:         l.Filename,
+			Key:              l.Key,
+			OriginalLength:   l.Length,
+			TranslatedLength: len(jis),
+			Headroom:         l.Length - len(jis),
+		})
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Headroom < rows[j].Headroom
+	})
+
+	out, err := gocsv.MarshalBytes(rows)
+	Fatal(err)
+	Fatal(writeFile(filepath.Join(*outputFolder, "encode_table.csv"), out))
+}
+
+// previewDiff prints every translation that is changed by the patch text
+// transformations, before and after the transformation.
+func previewDiff() {
+	for _, l := range loadTLLines() {
+		tl := translation(l)
+		if tl == "" || l.Key == "" {
+			continue
+		}
+		out := strings.Join(transformTLLine(l), "\n"+*splitMarker+"\n")
+		if out == tl {
+			continue
+		}
+		fmt.Printf("==== %s ====\n--- translation\n%s\n+++ patched\n%s\n\n", l.Key, tl, out)
+	}
+}
+
+// sheet writes the translated CSV to sheet.csv with the columns in the order
+// the shared sheet expects, so that it can be imported back into the sheet.
+// Comment rows are kept.
+func sheet() {
+	tlLines := loadTLLines()
+	for _, l := range tlLines {
+		l.TranslatedText = strings.ReplaceAll(l.TranslatedText, "\r\n", "\n")
+		l.EdittedText = strings.ReplaceAll(l.EdittedText, "\r\n", "\n")
+	}
+
+	out, err := gocsv.MarshalBytes(tlLines)
+	Fatal(err)
+	Fatal(writeFile(filepath.Join(*outputFolder, "sheet.csv"), withComments(out, tlLines)))
+}
+
+// withComments returns the CSV of lines written by gocsv with the comment
+// rows of each line put back around it. Comment rows before the header are
+// written after it.
+func withComments(data []byte, lines []*TLLine) []byte {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	Fatal(err)
+	var out bytes.Buffer
+	w := csv.NewWriter(&out)
+	Fatal(w.Write(records[0]))
+	for i, l := range lines {
+		var after [][]string
+		for _, c := range l.Comments {
+			if c.Row > l.Row {
+				after = append(after, c.Record)
+				continue
+			}
+			Fatal(w.Write(c.Record))
+		}
+		Fatal(w.Write(records[i+1]))
+		Fatal(w.WriteAll(after))
+	}
+	w.Flush()
+	Fatal(w.Error())
+	return out.Bytes()
+}
+
+// unchangedEng prints the lines whose text in the English SCN files is
+// identical to the original, meaning they were never translated in the old
+// build. File tags are skipped since they are never translated.
+func unchangedEng() {
+	originals := readLines(*scnFileFlag)
+	for _, key := range unchangedKeys(originals, readLines(*engScnFileFlag)) {
+		fmt.Printf("%s: %q\n", key, originals[key])
+	}
+}
+
+// unchangedKeys returns the sorted keys of the lines of eng that are not
+// blank and are the same as in originals, leaving out file tags.
+func unchangedKeys(originals, eng map[string]string) []string {
+	var keys []string
+	for key, text := range eng {
+		if _, st, _, err := scn.ParseKey(key); err != nil || st == scn.FileTagSegment {
+			continue
+		}
+		if orig, ok := originals[key]; ok && strings.TrimSpace(text) != "" && strings.TrimSpace(text) == strings.TrimSpace(orig) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// summarize returns the minimum, maximum, mean and median of values, which
+// must not be empty.
+func summarize(values []int) (min, max int, mean float64, median float64) {
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+	total := 0
+	for _, v := range sorted {
+		total += v
+	}
+	min, max = sorted[0], sorted[len(sorted)-1]
+	mean = float64(total) / float64(len(sorted))
+	if len(sorted)%2 == 1 {
+		median = float64(sorted[len(sorted)/2])
+	} else {
+		median = float64(sorted[len(sorted)/2-1]+sorted[len(sorted)/2]) / 2
+	}
+	return min, max, mean, median
+}
+
+// corpus prints statistics about the SCN files: their sizes and how many
+// segments they split into.
+func corpus() {
+	paths, err := globScn(*scnFileFlag)
+	Fatal(err)
+
+	var sizes, segments []int
+	totalBytes, totalSegments := 0, 0
+	for _, path := range paths {
+		data, err := readScn(path)
+		Fatal(err)
+		split, err := splitFile(filepath.Base(path), data)
+		if err != nil {
+			log.Printf("WARNING: skipping %s: %v", filepath.Base(path), err)
+			continue
+		}
+		sizes = append(sizes, len(data))
+		segments = append(segments, len(split))
+		totalBytes += len(data)
+		totalSegments += len(split)
+	}
+	if len(sizes) == 0 {
+		log.Fatalln("no files matched ", *scnFileFlag)
+	}
+
+	fmt.Printf("files: %d\ntotal bytes: %d\ntotal segments: %d\n", len(sizes), totalBytes, totalSegments)
+	min, max, mean, median := summarize(sizes)
+	fmt.Printf("file size: min %d, max %d, mean %.1f, median %.1f\n", min, max, mean, median)
+	min, max, mean, median = summarize(segments)
+	fmt.Printf("segments per file: min %d, max %d, mean %.1f, median %.1f\n", min, max, mean, median)
+
+	// Bucket the segment counts by powers of two.
+	buckets := make(map[int]int)
+	for _, n := range segments {
+		b := 1
+		for b < n {
+			b *= 2
+		}
+		buckets[b]++
+	}
+	var bounds []int
+	for b := range buckets {
+		bounds = append(bounds, b)
+	}
+	sort.Ints(bounds)
+	fmt.Println("segments per file distribution:")
+	for _, b := range bounds {
+		fmt.Printf("  <= %6d: %d\n", b, buckets[b])
+	}
+}
+
+// progress counts the lines of a set of segments and how many are translated.
+type progress struct {
+	total, translated int
+}
+
+func (p progress) String() string {
+	percent := 0.0
+	if p.total != 0 {
+		percent = 100 * float64(p.translated) / float64(p.total)
+	}
+	return fmt.Sprintf("%6d %10d %6.1f%%", p.total, p.translated, percent)
+}
+
+// stats prints how many of the lines extract would emit for the SCN files
+// have a translation, per file, per segment type and overall.
+func stats() {
+	translated := make(map[string]bool)
+	for _, l := range loadTLLines() {
+		if translation(l) != "" && l.Key != "" {
+			translated[l.Key] = true
+		}
+	}
+	paths, err := globScn(*scnFileFlag)
+	Fatal(err)
+
+	types := []scn.SegmentType{scn.TextSegment, scn.ChoiceSegment, scn.FileTagSegment}
+	byType := make(map[scn.SegmentType]*progress)
+	for _, st := range types {
+		byType[st] = &progress{}
+	}
+	var overall progress
+	fmt.Printf("%-16s %6s %10s %7s\n", "FILE", "TOTAL", "TRANSLATED", "PERCENT")
+	for _, path := range paths {
+		data, err := readScn(path)
+		Fatal(err)
+		base := filepath.Base(path)
+		split, err := splitFile(base, data)
+		if err != nil {
+			log.Printf("WARNING: skipping %s: %v", base, err)
+			continue
+		}
+		var file progress
+		seen := make(map[string]bool)
+		for _, ss := range split {
+			key := scn.Key(base, ss.Type, ss.Index)
+			// Split lines share a key and are translated together.
+			if ss.Type == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			file.total++
+			byType[ss.Type].total++
+			if translated[key] {
+				file.translated++
+				byType[ss.Type].translated++
+			}
+		}
+		overall.total += file.total
+		overall.translated += file.translated
+		fmt.Printf("%-16s %v\n", base, file)
+	}
+	fmt.Println()
+	for _, st := range types {
+		fmt.Printf("%-16s %v\n", st, byType[st])
+	}
+	fmt.Printf("%-16s %v\n", "total", overall)
+}
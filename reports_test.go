@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMissingGlyphs(t *testing.T) {
+	setFlags(t, map[string]string{"wordwrap": "10"})
+	glyphs := make(map[rune]bool)
+	for _, r := range "HeloBybx「」" {
+		glyphs[r] = true
+	}
+	for _, tc := range []struct {
+		name, key, tl string
+		want          []string
+	}{
+		{"all glyphs", "1_1_1.scn-text-0", "Hello", nil},
+		{"missing glyphs", "1_1_1.scn-text-0", "Hello wörld!", []string{"w", "ö", "r", "d", "!"}},
+		{"control codes", "1_1_1.scn-text-0", `\c12Hello\c0 \V"v 001"`, nil},
+		{"new line indicators", "1_1_1.scn-text-0", `Hello\NBye\nBye`, nil},
+		{"wrapped", "1_1_1.scn-text-0", "Hello Hello Hello", nil},
+		{"split marker", "1_1_1.scn-text-0", "Hello\n~~~~\nBye", nil},
+		{"escaped tildes", "1_1_1.scn-text-0", "Hello\n\\~~~~\nBye", []string{"~"}},
+		{"translator note", "1_1_1.scn-text-0", "Hello [[a note]]", nil},
+		{"replaced brackets", "1_1_1.scn-text-0", "【Bob】Hello", nil},
+		{"choice", "1_1_1.scn-choice-0", "Hello\nBye", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := &TLLine{Filename: "1_1_1.scn", Key: tc.key, TranslatedText: tc.tl}
+			if got := missingGlyphs(glyphs, l); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("missingGlyphs(%q) = %q, want %q", tc.tl, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSheetKeepsComments(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "tl.csv")
+	data := "# banner\n" +
+		"KEY,INDEX,TRANSLATED_TEXT\n" +
+		"# section 1\n" +
+		"1_1_1.scn-text-0,0,\"Hello\r\nthere\"\n" +
+		"# section 2,with a second cell\n" +
+		"1_1_1.scn-text-1,1,Bye\n" +
+		"# end\n"
+	m := useMemFS(t, map[string][]byte{src: []byte(data)})
+	setFlags(t, map[string]string{
+		"translatedCsv": src,
+		"outputFolder":  filepath.Join(dir, "out"),
+	})
+	sheet()
+
+	r := csv.NewReader(bytes.NewReader(readFile(t, m, filepath.Join(dir, "out", "sheet.csv"))))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, record := range records[1:] {
+		if strings.HasPrefix(record[0], "#") {
+			got = append(got, record)
+		} else {
+			got = append(got, []string{record[1], record[4]})
+		}
+	}
+	want := [][]string{
+		{"# banner"},
+		{"# section 1"},
+		{"1_1_1.scn-text-0", "Hello\nthere"},
+		{"# section 2", "with a second cell"},
+		{"1_1_1.scn-text-1", "Bye"},
+		{"# end"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sheet.csv = %q, want %q", got, want)
+	}
+}
+
+func TestUnchangedKeys(t *testing.T) {
+	originals := map[string]string{
+		"1_1_1.scn-text-0":        "こんにちは",
+		"1_1_1.scn-text-1":        "さようなら",
+		"1_1_1.scn-text-2":        " ",
+		"1_1_1.scn-choice-0":      "はい",
+		"1_1_1.scn-filetag-0":     "1_1_2.scn",
+		"op-filetag-1.scn-text-0": "こんにちは",
+	}
+	eng := map[string]string{
+		"1_1_1.scn-text-0":        "こんにちは ",
+		"1_1_1.scn-text-1":        "Goodbye",
+		"1_1_1.scn-text-2":        " ",
+		"1_1_1.scn-choice-0":      "はい",
+		"1_1_1.scn-filetag-0":     "1_1_2.scn",
+		"op-filetag-1.scn-text-0": "こんにちは",
+	}
+	want := []string{"1_1_1.scn-choice-0", "1_1_1.scn-text-0", "op-filetag-1.scn-text-0"}
+	if got := unchangedKeys(originals, eng); !reflect.DeepEqual(got, want) {
+		t.Errorf("unchangedKeys = %q, want %q", got, want)
+	}
+}
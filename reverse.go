@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/gocarina/gocsv"
+)
+
+// reverse updates the translations of the -translatedCsv from the
+// -engScnFiles, so that edits made directly to the English SCN files can be
+// copied back into the sheet. Lines whose translation would be patched into
+// the text already in the English file are left untouched, as are lines the
+// English file leaves untranslated. Changed translations are written to the
+// column they were read from, EDITTED_TEXT if it is set and TRANSLATED_TEXT
+// otherwise. The updated CSV is written to tllines.csv in the -outputFolder,
+// with the comment rows of the -translatedCsv kept in place.
+func reverse() {
+	tlLines := loadTLLines()
+	originals := readLines(*scnFileFlag)
+	engLines := readLines(*engScnFileFlag)
+
+	updated, missing := 0, 0
+	seen := make(map[string]bool)
+	for _, l := range tlLines {
+		if l.Key == "" {
+			continue
+		}
+		seen[l.Key] = true
+		eng, ok := engLines[l.Key]
+		if !ok {
+			missing++
+			continue
+		}
+		if eng == originals[l.Key] {
+			continue
+		}
+		if translation(l) != "" && strings.Join(transformTLLine(l), "\n"+*splitMarker+"\n") == eng {
+			continue
+		}
+		// TrimSpace like extract, since the padding of earlier translations
+		// is not part of the text.
+		tl := strings.TrimSpace(removePPNewLines(eng))
+		logV("%s: %q -> %q", l.Key, translation(l), tl)
+		if l.EdittedText != "" {
+			l.EdittedText = tl
+		} else {
+			l.TranslatedText = tl
+		}
+		updated++
+	}
+	if missing != 0 {
+		log.Printf("WARNING: %d lines of the translated csv are not in -engScnFiles", missing)
+	}
+	unknown := 0
+	for key, eng := range engLines {
+		if !seen[key] && eng != originals[key] {
+			unknown++
+		}
+	}
+	if unknown != 0 {
+		log.Printf("WARNING: %d translated lines of -engScnFiles have no row in the translated csv", unknown)
+	}
+	log.Printf("updated %d translations from -engScnFiles", updated)
+	if *outputFormat == "json" {
+		writeTLLines("tllines", tlLines)
+		return
+	}
+	out, err := gocsv.MarshalBytes(tlLines)
+	Fatal(err)
+	Fatal(writeFile(filepath.Join(*outputFolder, "tllines.csv"), withBOM(withComments(out, tlLines))))
+}
@@ -0,0 +1,453 @@
+package scn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Patcher replaces the lines of SCN files with translations.
+type Patcher struct {
+	Parser
+
+	// AllowLossyParse patches files that do not split into segments that
+	// combine back into the original data, with a warning.
+	AllowLossyParse bool
+
+	// Lines maps the Key of each segment to replace to the encoded bytes to
+	// replace it with. Further lines sharing the index are written as a
+	// terminator followed by the line start. If the file already has several
+	// lines with the key, each is replaced with one of the lines of the
+	// translation, which must have as many.
+	Lines map[string][]byte
+
+	// StrictSize reports whether the lines of a file must keep their
+	// original byte length. Longer translations are skipped, shorter ones
+	// are padded with spaces. Speech bubbles are never removed from strict
+	// size files.
+	StrictSize func(base string) bool
+
+	// Padding is repeated to pad lines that are shorter than the original in
+	// strict size mode. Bytes left over that are too few for another Padding
+	// are padded with spaces. The zero value pads with spaces.
+	Padding []byte
+
+	// Shrink is called with lines that are too long for strict size mode,
+	// and returns a shorter version of the line to try instead, or nil.
+	Shrink func(base string, ss *Segment, line []byte) []byte
+
+	// RouteChangeFiles are the files whose route change offsets are updated by
+	// FixRouteChange. "*" updates every file with route change markers.
+	RouteChangeFiles map[string]bool
+
+	// KeepBubbles reports whether the speech bubbles of a file should be kept.
+	KeepBubbles func(base string) bool
+
+	// SkipFOTSPatches leaves out the fixes to the FOTS translation that are
+	// made to a few files.
+	SkipFOTSPatches bool
+
+	// Untranslated is called with the text and choice segments that have no
+	// line in Lines, and returns the bytes to replace the segment with, or
+	// nil to leave it unchanged.
+	Untranslated func(base string, ss *Segment) []byte
+
+	// Transform is called with the bytes each segment is about to be
+	// replaced with, and returns the bytes to replace it with instead. It is
+	// not called with the Untranslated replacements.
+	Transform func(base string, ss *Segment, line []byte) []byte
+
+	// Check is called with the bytes each segment is about to be replaced
+	// with. The segment is left unchanged if it returns false.
+	Check func(base string, ss *Segment, line []byte) bool
+
+	// Warn is called with problems that do not stop a file from being
+	// patched.
+	Warn func(w *Warning)
+
+	// Debugf is called with verbose details of the patch.
+	Debugf func(format string, v ...interface{})
+}
+
+// Warning is a problem found while patching. The csv tags are the columns of
+// the warnings CSV written by purepure.
+type Warning struct {
+	File string `csv:"FILENAME"`
+	// Key is the Key of the segment the warning is about, if any.
+	Key              string `csv:"KEY"`
+	OriginalLength   int    `csv:"ORIGINAL_LENGTH"`
+	TranslatedLength int    `csv:"TRANSLATED_LENGTH"`
+	Reason           string `csv:"REASON"`
+}
+
+func (w *Warning) String() string {
+	switch {
+	case w.Key != "":
+		return w.Key + ": " + w.Reason
+	case w.File != "":
+		return w.File + ": " + w.Reason
+	default:
+		return w.Reason
+	}
+}
+
+// Result is a patched SCN file.
+type Result struct {
+	// Data is the patched file.
+	Data []byte
+
+	// Segments are the segments of the file with the translations applied.
+	Segments []*Segment
+
+	// FileSizeOffset is the difference between the size of the file and
+	// its file size header.
+	FileSizeOffset uint32
+
+	// StrictSize reports whether the lines kept their original byte length.
+	StrictSize bool
+
+	// LinesReplaced is the number of segments replaced with a translation.
+	LinesReplaced int
+
+	// LinesTooLong is the number of translations skipped because they are
+	// longer than the original line in strict size mode.
+	LinesTooLong int
+
+	// Shrunk are the keys of the lines that fit in strict size mode once
+	// Shrink shortened them.
+	Shrunk []string
+
+	// BubblesRemoved reports whether the speech bubbles were removed.
+	BubblesRemoved bool
+
+	// RouteChangeFixed reports whether route change offsets were updated.
+	RouteChangeFixed bool
+}
+
+func (p *Patcher) warn(w *Warning) {
+	if p.Warn != nil {
+		p.Warn(w)
+	}
+}
+
+func (p *Patcher) debugf(format string, v ...interface{}) {
+	if p.Debugf != nil {
+		p.Debugf(format, v...)
+	}
+}
+
+// Patch replaces the lines of the SCN file base with their translations,
+// and fixes up the header and offsets to match.
+func (p *Patcher) Patch(base string, data []byte) (*Result, error) {
+	if len(data) < 4 {
+		return nil, errors.New("file is too short to have a header")
+	}
+	strictSize := p.StrictSize != nil && p.StrictSize(base)
+	origFileSizeHeader := FileSizeHeader(data)
+	fileSizeOffset := uint32(len(data)) - origFileSizeHeader
+	// passes records the changes to the length of the file, so that route
+	// change offsets can be moved by the bytes added or removed before the
+	// position they point at.
+	var passes []edits
+	dropBubbles := !strictSize && (p.KeepBubbles == nil || !p.KeepBubbles(base))
+	if dropBubbles {
+		var bubblePasses []edits
+		data, bubblePasses = removeBubbles(data)
+		passes = append(passes, bubblePasses...)
+	}
+
+	split, err := p.SplitFile(data)
+	if errors.Is(err, ErrLossyParse) && p.AllowLossyParse || errors.Is(err, ErrMissingLineIndex) {
+		p.warn(&Warning{File: base, Reason: err.Error()})
+	} else if err != nil {
+		return nil, err
+	}
+	subLines := make(map[string]int)
+	for _, ss := range split {
+		if ss.Type != "" {
+			subLines[Key(base, ss.Type, ss.Index)]++
+		}
+	}
+	subLine := make(map[string]int)
+	starts := make([]int, len(split))
+	for i := 1; i < len(split); i++ {
+		starts[i] = starts[i-1] + len(split[i-1].Data)
+	}
+	var lineEdits edits
+	replaced, tooLong := 0, 0
+	var shrunk []string
+	for i, ss := range split {
+		if ss.Type == "" {
+			continue
+		}
+		key := Key(base, ss.Type, ss.Index)
+		eng := p.Lines[key]
+		untranslated := eng == nil
+		if untranslated && p.Untranslated != nil && ss.Type != FileTagSegment {
+			eng = p.Untranslated(base, ss)
+		}
+		if eng != nil {
+			if n := subLines[key]; n > 1 && !untranslated {
+				parts := bytes.Split(eng, append([]byte{p.Terminator}, LineStart(uint32(ss.Index))...))
+				i := subLine[key]
+				subLine[key]++
+				if len(parts) != n {
+					if i == 0 {
+						p.warn(&Warning{
+							File:             base,
+							Key:              key,
+							OriginalLength:   len(ss.Data),
+							TranslatedLength: len(eng),
+							Reason:           fmt.Sprintf("translation has %d split lines but the file has %d lines with this key, skipping it", len(parts), n),
+						})
+					}
+					continue
+				}
+				eng = parts[i]
+			}
+			if p.Transform != nil && !untranslated {
+				eng = p.Transform(base, ss, eng)
+			}
+			if strictSize {
+				if len(eng) > len(ss.Data) && p.Shrink != nil {
+					if short := p.Shrink(base, ss, eng); short != nil {
+						eng = short
+						if len(eng) <= len(ss.Data) {
+							p.debugf("%s: shrunk to %q to fit in %v bytes", key, Decode(eng), len(ss.Data))
+							shrunk = append(shrunk, key)
+						}
+					}
+				}
+				if len(eng) > len(ss.Data) {
+					p.warn(&Warning{
+						File:             base,
+						Key:              key,
+						OriginalLength:   len(ss.Data),
+						TranslatedLength: len(eng),
+						Reason:           fmt.Sprintf("Translation line %q (len: %v) is too long for line %q (len: %v) in strict size mode, leaving it untranslated; it must be cut by %v bytes to fit in %v bytes", Decode(eng), len(eng), Decode(ss.Data), len(ss.Data), len(eng)-len(ss.Data), len(ss.Data)),
+					})
+					tooLong++
+					continue
+				}
+				if len(eng) < len(ss.Data) {
+					eng = p.pad(base, key, eng, len(ss.Data))
+				}
+			}
+			if p.Check != nil && !p.Check(base, ss, eng) {
+				continue
+			}
+			if len(eng) != len(ss.Data) {
+				lineEdits = append(lineEdits, edit{pos: starts[i], delta: len(eng) - len(ss.Data)})
+			}
+			ss.Data = eng
+			replaced++
+		}
+	}
+	passes = append(passes, lineEdits)
+	outData := CombineSegments(split)
+	beforeFots := len(outData)
+	if !p.SkipFOTSPatches {
+		outData = fotsPatches(base, outData)
+	}
+	if diff := len(outData) - beforeFots; diff != 0 {
+		// The FOTS patches are not tracked byte by byte, so treat them as if
+		// they were at the start of the file.
+		passes = append(passes, edits{{pos: 0, delta: diff}})
+	}
+	if err := FixFileSizeHeader(outData, fileSizeOffset, split); err != nil {
+		p.warn(&Warning{File: base, Reason: err.Error()})
+	}
+	outData, routeChanges := p.fixRouteChange(base, outData, routeChangeDiff(passes, fileSizeOffset))
+	if err := CheckFileSizeHeader(outData, fileSizeOffset); err != nil {
+		p.warn(&Warning{File: base, Reason: err.Error()})
+	}
+	return &Result{
+		Data:             outData,
+		Segments:         split,
+		FileSizeOffset:   fileSizeOffset,
+		StrictSize:       strictSize,
+		LinesReplaced:    replaced,
+		LinesTooLong:     tooLong,
+		Shrunk:           shrunk,
+		BubblesRemoved:   dropBubbles,
+		RouteChangeFixed: routeChanges != 0,
+	}, nil
+}
+
+// pad returns line padded with p.Padding to size bytes.
+func (p *Patcher) pad(base, key string, line []byte, size int) []byte {
+	padding := p.Padding
+	if len(padding) == 0 {
+		padding = []byte{' '}
+	}
+	out := append([]byte{}, line...)
+	for size-len(out) >= len(padding) {
+		out = append(out, padding...)
+	}
+	if n := size - len(out); n != 0 {
+		p.warn(&Warning{
+			File:             base,
+			Key:              key,
+			OriginalLength:   size,
+			TranslatedLength: len(line),
+			Reason:           fmt.Sprintf("padding \"%s\" does not fit the last %d bytes of the line in strict size mode, padding them with spaces so that the line does not run into the next segment", HexEncode(padding), n),
+		})
+		out = append(out, bytes.Repeat([]byte{' '}, n)...)
+	}
+	return out
+}
+
+var reBubble0 = regexp.MustCompile("f0 45 f2 .. .. .. .. f2 .. .. .. .. f2 .. .. .. .. f2 .. .. .. ..")
+var reBubble1 = regexp.MustCompile("f0 46 f2 .. .. .. .. f0 20")
+var reBubble2 = regexp.MustCompile("f0 46 f2 07 00 00 00")
+
+// RemoveBubbles removes the speech bubble commands from an SCN file.
+func RemoveBubbles(data []byte) []byte {
+	data, _ = removeBubbles(data)
+	return data
+}
+
+// removeBubbles removes the speech bubble commands from an SCN file, and
+// returns the bytes removed by each pass.
+func removeBubbles(data []byte) ([]byte, []edits) {
+	var passes []edits
+	hexStr := HexEncode(data)
+	for _, re := range []*regexp.Regexp{reBubble0, reBubble1, reBubble2} {
+		// Earlier passes leave extra spaces behind, so byte positions are
+		// found by counting hex digits.
+		var es edits
+		digits, last := 0, 0
+		for _, m := range re.FindAllStringIndex(hexStr, -1) {
+			digits += len(hexStr[last:m[0]]) - strings.Count(hexStr[last:m[0]], " ")
+			n := len(hexStr[m[0]:m[1]]) - strings.Count(hexStr[m[0]:m[1]], " ")
+			es = append(es, edit{pos: digits / 2, delta: -n / 2})
+			digits += n
+			last = m[1]
+		}
+		passes = append(passes, es)
+		hexStr = re.ReplaceAllString(hexStr, "")
+	}
+	return hexDecode(hexStr), passes
+}
+
+// edit is a change to the length of a file: delta bytes were inserted at
+// pos, or removed from pos if delta is negative.
+type edit struct {
+	pos, delta int
+}
+
+// edits are the non-overlapping changes made to a file in a single pass.
+// Their positions are in the file before the pass.
+type edits []edit
+
+// move returns the position of the byte at pos after the edits.
+func (es edits) move(pos int) int {
+	moved := pos
+	for _, e := range es {
+		if e.pos < pos {
+			moved += e.delta
+		}
+	}
+	return moved
+}
+
+var reRouteChange = regexp.MustCompile("f2 .. .. .. .. f0 1a f1")
+
+// FixRouteChange moves the route change offsets by fileSizeDiff bytes if file
+// is one of the RouteChangeFiles. A route change marker is an "f2" followed by
+// the 4-byte little endian offset and a file tag start. For example, in a file
+// that grew by 16 bytes, "f2 10 02 00 00 f0 1a f1" becomes
+// "f2 20 02 00 00 f0 1a f1".
+//
+// Patch instead moves each offset by the bytes added or removed before the
+// position it points at, counted like the choice destinations from the end of
+// the header, so that it is not affected by changes after that position.
+func (p *Patcher) FixRouteChange(file string, data []byte, fileSizeDiff int) []byte {
+	data, _ = p.fixRouteChange(file, data, func(uint32) int { return fileSizeDiff })
+	return data
+}
+
+// FixRouteChangeSegments moves the route change offsets of a file rebuilt
+// from segs like Patch does, by the bytes added or removed before the
+// position each offset points at. origLengths are the lengths of the
+// segments in the original file.
+func (p *Patcher) FixRouteChangeSegments(file string, data []byte, fileSizeOffset uint32, segs []*Segment, origLengths []int) []byte {
+	var es edits
+	pos := 0
+	for i, ss := range segs {
+		if delta := len(ss.Data) - origLengths[i]; delta != 0 {
+			es = append(es, edit{pos: pos, delta: delta})
+		}
+		pos += origLengths[i]
+	}
+	data, _ = p.fixRouteChange(file, data, routeChangeDiff([]edits{es}, fileSizeOffset))
+	return data
+}
+
+// routeChangeDiff returns the number of bytes the passes moved the position a
+// route change offset points at. Offsets are counted from the end of the
+// header, like choice destinations.
+func routeChangeDiff(passes []edits, fileSizeOffset uint32) func(offset uint32) int {
+	return func(offset uint32) int {
+		pos := int(offset) + int(fileSizeOffset)
+		moved := pos
+		for _, es := range passes {
+			moved = es.move(moved)
+		}
+		return moved - pos
+	}
+}
+
+// fixRouteChange moves each route change offset by the number of bytes
+// returned by diff for it, and returns the number of offsets found.
+func (p *Patcher) fixRouteChange(file string, data []byte, diff func(offset uint32) int) ([]byte, int) {
+	hexStr := HexEncode(data)
+	if !p.RouteChangeFiles[file] && !p.RouteChangeFiles["*"] {
+		if reRouteChange.MatchString(hexStr) {
+			p.debugf("%s: has route change markers, but is not one of the route change files", file)
+		}
+		return data, 0
+	}
+
+	n := 0
+
+	hexStr = reRouteChange.ReplaceAllStringFunc(hexStr, func(s string) string {
+		n++
+		offsetStr := s[3 : 3+11]
+		offset := FileSizeHeader(hexDecode(offsetStr))
+		offset = uint32(int(offset) + diff(offset))
+		offsetBytes := make([]byte, 4)
+		binary.LittleEndian.PutUint32(offsetBytes, offset)
+		newOffsetStr := HexEncode(offsetBytes)
+		out := "f2 " + newOffsetStr + " f0 1a f1"
+		p.debugf("%s: updating route change offset from %q to %q\n%q\n%q", file, offsetStr, newOffsetStr, s, out)
+		return out
+	})
+
+	return hexDecode(hexStr), n
+}
+
+func fotsPatches(file string, data []byte) []byte {
+	switch file {
+	case "1_6_2.scn":
+		// Patch for 1_6_2 (present from sachi scene).
+		// Adds the "try your best" CG and keeps music playing at the end of the scene.
+		hexStr := HexEncode(data)
+		hexStr = strings.ReplaceAll(hexStr, "f3 19 00 00", "f0 23 f2 07 00 00 00 f2 80 00 00 00 f2 2c 01 00 00 f2 00 00 00 00 f0 20 f3 19 00 00")
+		hexStr = strings.ReplaceAll(hexStr, "f0 2d f2 b8 0b 00 00 f3 1d", "f0 19 f1 50 50 4e 31 4e 00 f2 00 00 00 00 f2 80 00 00 00 f2 a0 0f 00 00 f2 01 00 00 00 f0 20 f3 1d")
+		hexStr = strings.ReplaceAll(hexStr, "f3 22 00 00 00", "f0 19 f1 50 50 4e 32 4e 00 f2 00 00 00 00 f2 80 00 00 00 f2 a0 0f 00 00 f2 01 00 00 00 f0 20 f3 22 00 00 00")
+		hexStr = strings.ReplaceAll(hexStr, "f0 23 f2 07 00 00 00 f2 80 00 00 00 f2 2c 01 00 00 f2 00 00 00 00 f0 20 f3 26 00 00 00", "f3 26 00 00 00")
+		return hexDecode(hexStr)
+	case "1_5_22.scn":
+		// Change BGM01 to BGM19.
+		hexStr := HexEncode(data)
+		hexStr = strings.ReplaceAll(hexStr, "42 47 4d 30 31", "42 47 4d 31 39")
+		return hexDecode(hexStr)
+	default:
+		return data
+	}
+
+}
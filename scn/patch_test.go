@@ -0,0 +1,188 @@
+package scn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// scnFile returns an SCN file with a 4 byte file size header followed by
+// the parts, so that its file size offset is 4.
+func scnFile(parts ...[]byte) []byte {
+	data := append([]byte{0, 0, 0, 0}, bytes.Join(parts, nil)...)
+	binary.LittleEndian.PutUint32(data, uint32(len(data)-4))
+	return data
+}
+
+// routeChange returns a route change marker pointing at offset, followed by
+// the name of the destination file and the terminator.
+func routeChange(offset uint32) []byte {
+	b := []byte{0xf2, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(b[1:], offset)
+	return append(append(b, FileTagStart()...), "1_1_2.scn\x00"...)
+}
+
+// line returns text line i with the text s.
+func line(i uint32, s string) []byte {
+	return append(append(LineStart(i), s...), 0)
+}
+
+// routeChangeOffset returns the offset of the first route change marker in
+// data.
+func routeChangeOffset(t *testing.T, data []byte) uint32 {
+	t.Helper()
+	i := bytes.Index(data, FileTagStart())
+	if i < 5 || data[i-5] != 0xf2 {
+		t.Fatalf("no route change marker in % x", data)
+	}
+	return binary.LittleEndian.Uint32(data[i-4:])
+}
+
+func TestEditsMove(t *testing.T) {
+	es := edits{{pos: 10, delta: -4}, {pos: 20, delta: 3}}
+	for _, tc := range []struct {
+		pos, want int
+	}{
+		{0, 0},
+		{10, 10},
+		{11, 7},
+		{20, 16},
+		{21, 20},
+		{100, 99},
+	} {
+		if got := es.move(tc.pos); got != tc.want {
+			t.Errorf("move(%d) = %d, want %d", tc.pos, got, tc.want)
+		}
+	}
+}
+
+func TestPatchRouteChange(t *testing.T) {
+	bubble := []byte{0xf0, 0x46, 0xf2, 0x07, 0x00, 0x00, 0x00}
+	// before is everything up to the line the route change points at.
+	before := [][]byte{bubble, line(0, "abc"), routeChange(0)}
+	target := uint32(len(bytes.Join(before, nil)))
+	data := scnFile(bubble, line(0, "abc"), routeChange(target), line(1, "def"), line(2, "ghi"))
+
+	for _, tc := range []struct {
+		name  string
+		lines map[string][]byte
+		keep  bool
+		// want is the change to the route change offset.
+		want int
+	}{
+		{"nothing changed", nil, true, 0},
+		{"bubble removed before the target", nil, false, -len(bubble)},
+		{"line before the target", map[string][]byte{"t.scn-text-0": []byte("abcdef")}, true, 3},
+		{"line after the target", map[string][]byte{"t.scn-text-2": []byte("g")}, true, 0},
+		{"bubble removed and lines changed", map[string][]byte{
+			"t.scn-text-0": []byte("a"),
+			"t.scn-text-1": []byte("defdef"),
+			"t.scn-text-2": []byte("ghighi"),
+		}, false, -len(bubble) - 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Patcher{
+				Lines:            tc.lines,
+				RouteChangeFiles: map[string]bool{"t.scn": true},
+				KeepBubbles:      func(string) bool { return tc.keep },
+			}
+			res, err := p.Patch("t.scn", append([]byte{}, data...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := routeChangeOffset(t, res.Data), uint32(int(target)+tc.want); got != want {
+				t.Errorf("route change offset = %d, want %d", got, want)
+			}
+			if !res.RouteChangeFixed {
+				t.Error("RouteChangeFixed = false, want true")
+			}
+			if err := CheckFileSizeHeader(res.Data, res.FileSizeOffset); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestPatchRouteChangeOtherFile(t *testing.T) {
+	data := scnFile(line(0, "abc"), routeChange(7), line(1, "def"))
+	p := &Patcher{
+		Lines:            map[string][]byte{"t.scn-text-0": []byte("abcdef")},
+		RouteChangeFiles: map[string]bool{"other.scn": true},
+	}
+	res, err := p.Patch("t.scn", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := routeChangeOffset(t, res.Data); got != 7 {
+		t.Errorf("route change offset = %d, want it unchanged at 7", got)
+	}
+}
+
+func TestFixRouteChangeSegments(t *testing.T) {
+	// The route change points at the start of the second line.
+	target := uint32(len(line(0, "abc")) + len(routeChange(0)))
+	data := scnFile(line(0, "abc"), routeChange(target), line(1, "def"))
+	segs, err := SplitFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var origLengths []int
+	for _, ss := range segs {
+		origLengths = append(origLengths, len(ss.Data))
+		if ss.Type == TextSegment {
+			ss.Data = append(append([]byte{}, ss.Data...), "xy"...)
+		}
+	}
+	p := &Patcher{RouteChangeFiles: map[string]bool{"*": true}}
+	out := p.FixRouteChangeSegments("t.scn", CombineSegments(segs), 4, segs, origLengths)
+	// Only the first line is before the target.
+	if got, want := routeChangeOffset(t, out), target+2; got != want {
+		t.Errorf("route change offset = %d, want %d", got, want)
+	}
+}
+
+func TestPatchSplitLines(t *testing.T) {
+	// The FOTS translation added a second line with index 0.
+	data := scnFile(line(0, "abc"), line(0, "def"), line(1, "ghi"))
+	// split returns the translation of the parts as lines sharing index 0.
+	sep := string(append([]byte{0}, LineStart(0)...))
+	split := func(parts ...string) []byte {
+		return []byte(strings.Join(parts, sep))
+	}
+	for _, tc := range []struct {
+		name string
+		eng  []byte
+		want []byte
+		// warn is whether the split count mismatch is warned about.
+		warn bool
+	}{
+		{"split lines match", split("A", "B"), scnFile(line(0, "A"), line(0, "B"), line(1, "ghi")), false},
+		{"too few split lines", split("A"), data, true},
+		{"too many split lines", split("A", "B", "C"), data, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var warnings []*Warning
+			p := &Patcher{
+				Lines: map[string][]byte{"t.scn-text-0": tc.eng},
+				Warn:  func(w *Warning) { warnings = append(warnings, w) },
+			}
+			res, err := p.Patch("t.scn", append([]byte{}, data...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(res.Data, tc.want) {
+				t.Errorf("Patch = % x, want % x", res.Data, tc.want)
+			}
+			var mismatches int
+			for _, w := range warnings {
+				if w.Key == "t.scn-text-0" && strings.Contains(w.Reason, "split lines") {
+					mismatches++
+				}
+			}
+			if tc.warn && mismatches != 1 || !tc.warn && mismatches != 0 {
+				t.Errorf("got %d split line warnings, want warn %v: %v", mismatches, tc.warn, warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+// Package scn parses and patches the SCN script files used by Pure Pure.
+package scn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+)
+
+type SegmentType string
+
+const (
+	TextSegment    SegmentType = "text"
+	ChoiceSegment  SegmentType = "choice"
+	FileTagSegment SegmentType = "filetag"
+)
+
+// Segment represents a portion of an SCN file. Segments without a Type hold
+// the bytes between text, choice and file tag segments. The Data of a text,
+// choice or file tag segment is everything after its start marker up to, but
+// not including, the terminator, so control codes written as text, such as
+// voice tags, are part of it and are replaced along with the text.
+type Segment struct {
+	Type  SegmentType
+	Index int
+	Data  []byte
+}
+
+// ErrLossyParse is returned by SplitFile when the segments it found do not
+// combine back into the original data.
+var ErrLossyParse = errors.New("combined segments do not match the original data")
+
+// ErrNoTerminator is returned by SplitFile when a line has no terminator
+// before the end of the file, which usually means the file is truncated or
+// uses a different terminator.
+var ErrNoTerminator = errors.New("did not find end to line")
+
+// ErrMissingLineIndex is returned by SplitFile with CheckIndices set when the
+// line start of a text line index is not found, but a later one is.
+var ErrMissingLineIndex = errors.New("missing line index")
+
+// maxLineIndexGap is the number of indices after a missing one that
+// CheckIndices looks for.
+const maxLineIndexGap = 16
+
+// ParseError records the byte offset in the SCN file at which parsing failed.
+type ParseError struct {
+	Offset int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("offset %d (%#x): %v", e.Offset, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// LineStart returns the sequence of bytes that indicates the start of the
+// 'i'th  dialog line in the SCN file.
+func LineStart(i uint32) []byte {
+	b := make([]byte, 5)
+	b[0] = 0xf3
+	binary.LittleEndian.PutUint32(b[1:], i)
+	return b
+}
+
+// ChoiceStart returns the sequence of bytes that indicates the start of a
+// choice in the SCN file.
+func ChoiceStart() []byte {
+	return []byte{0xf0, 0x1c, 0xf1}
+}
+
+// FileTagStart returns the sequence of bytes that indicates the start of a
+// file name that is the destination of a choice.
+func FileTagStart() []byte {
+	return []byte{0xf0, 0x1a, 0xf1}
+}
+
+// TextEncoding is the encoding of the text in SCN files, used by Decode and
+// Encode. The game uses shift-JIS, but some re-releases of the scripts use
+// other encodings.
+var TextEncoding encoding.Encoding = japanese.ShiftJIS
+
+// Decode takes a slice of TextEncoding encoded text and returns it as a UTF-8
+// encoded string. Returns an empty string on failure
+func Decode(data []byte) string {
+	utf8Bytes, err := TextEncoding.NewDecoder().Bytes(data)
+	if err != nil {
+		return ""
+	}
+
+	return string(utf8Bytes)
+}
+
+// EncodeError reports a rune that cannot be represented in TextEncoding.
+type EncodeError struct {
+	Rune rune
+	// Offset is the byte offset of Rune in the encoded string.
+	Offset int
+}
+
+func (e *EncodeError) Error() string {
+	return fmt.Sprintf("%q (%U) at byte %d cannot be encoded", e.Rune, e.Rune, e.Offset)
+}
+
+// Encode returns s as TextEncoding encoded text. If s cannot be encoded, the
+// error is an *EncodeError for the first rune that cannot be represented.
+func Encode(s string) ([]byte, error) {
+	out, err := TextEncoding.NewEncoder().Bytes([]byte(s))
+	if err == nil {
+		return out, nil
+	}
+	for i, r := range s {
+		if _, rErr := TextEncoding.NewEncoder().String(string(r)); rErr != nil {
+			return nil, &EncodeError{Rune: r, Offset: i}
+		}
+	}
+	return nil, err
+}
+
+// Parser splits SCN files into segments.
+type Parser struct {
+	// Terminator is the byte that ends each line, choice and file tag. The
+	// zero value is the terminator used by the game.
+	Terminator byte
+
+	// CheckIndices looks for the line starts of the indices after the last
+	// text line found. Lines are found by their index, so if one line start is
+	// missing or obscured by the bytes before it, none of the lines after it
+	// are found, and their translations are used for the wrong lines.
+	CheckIndices bool
+}
+
+// SplitFile parses an SCN file into a slice of Segments using the default
+// Parser.
+func SplitFile(data []byte) ([]*Segment, error) {
+	return (&Parser{}).SplitFile(data)
+}
+
+// SplitFile parses an SCN file into a slice of Segments. Errors are returned
+// as a *ParseError. If the segments do not combine back into data, they are
+// returned along with an error wrapping ErrLossyParse. Likewise, if
+// CheckIndices finds a missing line index, they are returned along with an
+// error wrapping ErrMissingLineIndex.
+func (p *Parser) SplitFile(data []byte) ([]*Segment, error) {
+	var out []*Segment
+
+	remaining := data
+
+	indexMap := make(map[SegmentType]int)
+	// textEnd is the offset of the end of the last text line.
+	textEnd := 0
+	for {
+		lineType := TextSegment
+		ls := LineStart(uint32(indexMap[lineType]))
+		begin := bytes.Index(remaining, ls)
+		if choiceBegin := bytes.Index(remaining, ChoiceStart()); choiceBegin != -1 && (begin == -1 || choiceBegin < begin) {
+			ls = ChoiceStart()
+			begin = choiceBegin
+			lineType = ChoiceSegment
+		}
+		if fileTagBegin := bytes.Index(remaining, FileTagStart()); fileTagBegin != -1 && (begin == -1 || fileTagBegin < begin) {
+			ls = FileTagStart()
+			begin = fileTagBegin
+			lineType = FileTagSegment
+		}
+
+		if begin == -1 {
+			// no more data
+			out = append(out, &Segment{Data: remaining})
+			break
+		}
+		begin += len(ls)
+		length := bytes.IndexByte(remaining[begin:], p.Terminator)
+		if length == -1 {
+			return nil, &ParseError{Offset: len(data) - len(remaining) + begin, Err: ErrNoTerminator}
+		}
+		out = append(out, &Segment{Data: remaining[:begin]})
+		out = append(out, &Segment{Type: lineType, Index: indexMap[lineType], Data: remaining[begin : begin+length]})
+		remaining = remaining[begin+length:]
+		if lineType == TextSegment {
+			textEnd = len(data) - len(remaining)
+		}
+
+		// The FOTS translation added new lines, usually with the same index as the
+		// preceding line. Include these as text lines with the same index as the
+		// original.
+		if !(lineType == TextSegment && bytes.Index(remaining, ls) != -1) {
+			indexMap[lineType]++
+		}
+	}
+
+	if combined := CombineSegments(out); !bytes.Equal(data, combined) {
+		offset := 0
+		for offset < len(data) && offset < len(combined) && data[offset] == combined[offset] {
+			offset++
+		}
+		return out, &ParseError{Offset: offset, Err: ErrLossyParse}
+	}
+	if p.CheckIndices {
+		missing := indexMap[TextSegment]
+		for next := missing + 1; next <= missing+maxLineIndexGap; next++ {
+			if i := bytes.Index(data[textEnd:], LineStart(uint32(next))); i != -1 {
+				return out, &ParseError{
+					Offset: textEnd + i,
+					Err:    fmt.Errorf("%w %d, the lines from index %d on are not parsed", ErrMissingLineIndex, missing, next),
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// CombineSegments returns the passed slice of Segments as a single slice
+// of bytes that can be written as an SCN file.
+func CombineSegments(segs []*Segment) []byte {
+	var out []byte
+	for _, s := range segs {
+		out = append(out, s.Data...)
+	}
+	return out
+}
+
+// FileSizeHeader takes an SCN file, and returns the file size header
+// stored as a 4-byte little endian value at the start of the file.
+func FileSizeHeader(data []byte) uint32 {
+	return binary.LittleEndian.Uint32(data)
+}
+
+// NumChoices returns the number of 36 byte choice records in the header of
+// an SCN file, which are stored after the first 12 bytes.
+func NumChoices(fileSizeOffset uint32) uint32 {
+	if fileSizeOffset <= 12 {
+		return 0
+	}
+	return (fileSizeOffset - 12) / 36
+}
+
+// CheckFileSizeHeader returns an error if the file size header of data does
+// not match its size, for the final bytes of a patched file.
+func CheckFileSizeHeader(data []byte, fileSizeOffset uint32) error {
+	if len(data) < 4 {
+		return errors.New("file is too short to have a header")
+	}
+	if header, size := FileSizeHeader(data), uint32(len(data))-fileSizeOffset; header != size {
+		return fmt.Errorf("file size header %v does not match the patched file size %v", header, size)
+	}
+	return nil
+}
+
+// FixFileSizeHeader updates the file size header and the choice destination
+// offsets of a patched SCN file. An error is returned if the header does not
+// match the choices found in the file, in which case the choice offsets are
+// left unchanged.
+func FixFileSizeHeader(data []byte, fileSizeOffset uint32, segs []*Segment) error {
+	binary.LittleEndian.PutUint32(data, uint32(len(data))-fileSizeOffset)
+	numChoices := NumChoices(fileSizeOffset)
+	if numChoices == 0 {
+		return nil
+	}
+
+	var pos uint32
+	var choicePos []uint32
+	for _, ss := range segs {
+		if ss.Type == FileTagSegment {
+			choicePos = append(choicePos, pos)
+		}
+		pos += uint32(len(ss.Data))
+	}
+	if uint32(len(choicePos)) != numChoices {
+		return fmt.Errorf("header suggests there should be %v choices, but only found %v in file", numChoices, len(choicePos))
+	}
+
+	for i := uint32(0); i < numChoices; i++ {
+		binary.LittleEndian.PutUint32(data[12+(36*i)+32:], choicePos[i]-fileSizeOffset-uint32(len(FileTagStart())))
+	}
+	return nil
+}
+
+// Key returns the key that identifies a segment in the translation CSV.
+func Key(base string, st SegmentType, lineIndex int) string {
+	return fmt.Sprintf("%v-%v-%v", base, st, lineIndex)
+}
+
+// ParseKey splits a key returned by Key into its parts.
+func ParseKey(key string) (base string, st SegmentType, lineIndex int, err error) {
+	i := strings.LastIndex(key, "-")
+	if i == -1 {
+		return "", "", 0, fmt.Errorf("invalid key %q", key)
+	}
+	lineIndex, err = strconv.Atoi(key[i+1:])
+	if err != nil {
+		return "", "", 0, fmt.Errorf("invalid key %q: %v", key, err)
+	}
+	j := strings.LastIndex(key[:i], "-")
+	if j == -1 {
+		return "", "", 0, fmt.Errorf("invalid key %q", key)
+	}
+	return key[:j], SegmentType(key[j+1 : i]), lineIndex, nil
+}
+
+// HexEncode returns data as space separated hex bytes, e.g. "f0 1a f1".
+func HexEncode(data []byte) string {
+	var out strings.Builder
+	hexStr := hex.EncodeToString(data)
+
+	for i := 0; i < len(hexStr)/2; i++ {
+		out.WriteByte(hexStr[2*i])
+		out.WriteByte(hexStr[(2*i)+1])
+		if i != (len(hexStr)/2)-1 {
+			out.WriteRune(' ')
+		}
+	}
+	return out.String()
+}
+
+// hexDecode is the inverse of HexEncode. It is only used on strings built by
+// this package, so invalid input is a bug.
+func hexDecode(data string) []byte {
+	out, err := hex.DecodeString(strings.ReplaceAll(data, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
@@ -0,0 +1,97 @@
+package scn
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSplitFileTerminator(t *testing.T) {
+	var data []byte
+	data = append(data, 0, 0, 0, 0)
+	data = append(append(append(data, LineStart(0)...), "abc"...), 0xff)
+	data = append(append(append(data, ChoiceStart()...), "yes"...), 0xff)
+	data = append(append(append(data, FileTagStart()...), "1_1_2.scn"...), 0xff)
+	data = append(append(append(data, LineStart(1)...), "a\x00b"...), 0xff)
+
+	p := &Parser{Terminator: 0xff}
+	segs, err := p.SplitFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		st    SegmentType
+		index int
+		data  string
+	}{
+		{TextSegment, 0, "abc"},
+		{ChoiceSegment, 0, "yes"},
+		{FileTagSegment, 0, "1_1_2.scn"},
+		{TextSegment, 1, "a\x00b"},
+	}
+	var got []*Segment
+	for _, ss := range segs {
+		if ss.Type != "" {
+			got = append(got, ss)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d segments, want %d: %v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		if got[i].Type != w.st || got[i].Index != w.index || string(got[i].Data) != w.data {
+			t.Errorf("segment %d = %s %d %q, want %s %d %q", i, got[i].Type, got[i].Index, got[i].Data, w.st, w.index, w.data)
+		}
+	}
+	if combined := CombineSegments(segs); !bytes.Equal(combined, data) {
+		t.Errorf("CombineSegments = % x, want % x", combined, data)
+	}
+
+	// The default terminator runs the first line on to the zero byte in the
+	// last one.
+	segs, err = SplitFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first := segs[1]; string(first.Data) == "abc" {
+		t.Errorf("SplitFile with the default terminator ended the first line at 0xff")
+	}
+
+	// A line that is never terminated is an error.
+	if _, err := p.SplitFile(data[:len(data)-1]); !errors.Is(err, ErrNoTerminator) {
+		t.Errorf("SplitFile of an unterminated line: got error %v, want %v", err, ErrNoTerminator)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	for _, tc := range []struct {
+		key   string
+		base  string
+		st    SegmentType
+		index int
+		ok    bool
+	}{
+		{"1_1_1.scn-text-0", "1_1_1.scn", TextSegment, 0, true},
+		{"1_1_1.scn-choice-12", "1_1_1.scn", ChoiceSegment, 12, true},
+		{"1_1_1.scn-filetag-3", "1_1_1.scn", FileTagSegment, 3, true},
+		{"a-b.scn-text-1", "a-b.scn", TextSegment, 1, true},
+		{"1_1_1.scn-text-x", "", "", 0, false},
+		{"1_1_1.scn-1", "", "", 0, false},
+		{"text", "", "", 0, false},
+		{"", "", "", 0, false},
+	} {
+		base, st, index, err := ParseKey(tc.key)
+		if (err == nil) != tc.ok {
+			t.Errorf("ParseKey(%q): got error %v, want ok %v", tc.key, err, tc.ok)
+			continue
+		}
+		if base != tc.base || st != tc.st || index != tc.index {
+			t.Errorf("ParseKey(%q) = %q, %q, %d, want %q, %q, %d", tc.key, base, st, index, tc.base, tc.st, tc.index)
+		}
+		if tc.ok {
+			if key := Key(base, st, index); key != tc.key {
+				t.Errorf("Key(ParseKey(%q)) = %q", tc.key, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var fileModeFlag = flag.String("fileMode", "0644", "octal permissions of the files written by patch, extract and the other modes")
+
+// zipSeparator separates the path of a zip archive from the path of an entry
+// in it, as in "scripts.zip!script/1_1_1.scn".
+const zipSeparator = "!"
+
+// fileSystem is the file system the modes read their input from and write
+// their output to.
+type fileSystem interface {
+	ReadFile(name string) ([]byte, error)
+	// WriteFile writes data to name with the perm permissions, replacing
+	// the file and its permissions if it already exists.
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	// Glob returns the names of the files matching pattern, as
+	// filepath.Glob does.
+	Glob(pattern string) ([]string, error)
+}
+
+// fsys is the file system every mode uses. Tests can replace it with a
+// memFS, so that extract and patch run without touching the disk.
+var fsys fileSystem = osFS{}
+
+// osFS is the fileSystem of the operating system.
+type osFS struct{}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (osFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+// WriteFile writes data to a temporary file in the directory of name and
+// renames it to name, so that an interrupted run never leaves a truncated
+// file behind. The renamed file replaces any file at name, so it has the perm
+// permissions even if name already existed with others.
+func (osFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// memFS is a fileSystem that keeps files in memory, keyed by their cleaned
+// path. It is safe for concurrent use, as patch writes files in parallel.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// newMemFS returns a memFS holding files, keyed by path.
+func newMemFS(files map[string][]byte) *memFS {
+	m := &memFS{files: make(map[string][]byte)}
+	for name, data := range files {
+		m.files[filepath.Clean(name)] = data
+	}
+	return m
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (m *memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[filepath.Clean(name)] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memFS) Glob(pattern string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pattern = filepath.Clean(pattern)
+	var names []string
+	for name := range m.files {
+		match, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+var (
+	zipArchivesMu sync.Mutex
+	zipArchives   = make(map[string]*zip.Reader)
+)
+
+// openZip returns the zip archive at path. Archives are read once and kept
+// in memory until the program exits.
+func openZip(path string) (*zip.Reader, error) {
+	zipArchivesMu.Lock()
+	defer zipArchivesMu.Unlock()
+	if r, ok := zipArchives[path]; ok {
+		return r, nil
+	}
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	zipArchives[path] = r
+	return r, nil
+}
+
+// splitZipPath splits a path or glob of the form "archive.zip!entry" into
+// the archive and entry. A path ending in ".zip" matches every SCN file in
+// the archive. ok is false for paths that are not in a zip archive.
+func splitZipPath(p string) (archive, entry string, ok bool) {
+	if i := strings.Index(p, ".zip"+zipSeparator); i != -1 {
+		return p[:i+len(".zip")], p[i+len(".zip"+zipSeparator):], true
+	}
+	if strings.HasSuffix(p, ".zip") {
+		return p, "*.scn", true
+	}
+	return "", "", false
+}
+
+// globScn returns the SCN files matching glob. Globs in a zip archive, such
+// as "scripts.zip!script/*.scn", return paths that readScn reads from the
+// archive. filepath.Base of these paths is the name of the entry.
+func globScn(glob string) ([]string, error) {
+	archive, pattern, ok := splitZipPath(glob)
+	if !ok {
+		return fsys.Glob(glob)
+	}
+	r, err := openZip(archive)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, f := range r.File {
+		name := f.Name
+		if !strings.Contains(pattern, "/") {
+			// A pattern without a directory matches entries in any directory.
+			name = path.Base(name)
+		}
+		match, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if match && !f.FileInfo().IsDir() {
+			paths = append(paths, archive+zipSeparator+f.Name)
+		}
+	}
+	return paths, nil
+}
+
+// readScn reads an SCN file returned by globScn.
+func readScn(p string) ([]byte, error) {
+	archive, entry, ok := splitZipPath(p)
+	if !ok {
+		return fsys.ReadFile(p)
+	}
+	r, err := openZip(archive)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range r.File {
+		if f.Name != entry {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+	return nil, fmt.Errorf("%s: no such entry in %s", entry, archive)
+}
+
+// fileMode returns the -fileMode.
+func fileMode() os.FileMode {
+	mode, err := strconv.ParseUint(*fileModeFlag, 8, 32)
+	if err != nil || mode > 0777 {
+		log.Fatalln("invalid fileMode: ", *fileModeFlag)
+	}
+	return os.FileMode(mode)
+}
+
+// writeFile writes data to name with the -fileMode permissions.
+func writeFile(name string, data []byte) error {
+	return fsys.WriteFile(name, data, fileMode())
+}
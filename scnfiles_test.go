@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMemFS(t *testing.T) {
+	m := newMemFS(map[string][]byte{
+		"script/b.scn":     []byte("b"),
+		"./script/a.scn":   []byte("a"),
+		"script/c.txt":     []byte("c"),
+		"other/script.scn": []byte("d"),
+	})
+
+	if _, err := m.ReadFile("script/missing.scn"); !os.IsNotExist(err) {
+		t.Errorf("ReadFile of a missing file: got error %v, want one that is not exist", err)
+	}
+	data, err := m.ReadFile("script//a.scn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a" {
+		t.Errorf("ReadFile = %q, want %q", data, "a")
+	}
+	// Changing what a read returned or what was written does not change the
+	// file.
+	data[0] = 'x'
+	written := []byte("new")
+	if err := m.WriteFile("out/a.scn", written, 0644); err != nil {
+		t.Fatal(err)
+	}
+	written[0] = 'x'
+	for name, want := range map[string]string{"script/a.scn": "a", "out/a.scn": "new"} {
+		if got := readFile(t, m, name); string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	names, err := m.Glob("./script/*.scn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"script/a.scn", "script/b.scn"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Glob = %q, want %q", names, want)
+	}
+	if _, err := m.Glob("["); err == nil {
+		t.Error("Glob of a malformed pattern: got no error")
+	}
+}
+
+func TestOSFSWriteFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "1_1_1.scn")
+	if err := ioutil.WriteFile(name, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := (osFS{}).WriteFile(name, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new" {
+		t.Errorf("WriteFile wrote %q, want %q", data, "new")
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0644 {
+		t.Errorf("WriteFile over a 0600 file left permissions %v, want %v", got, os.FileMode(0644))
+	}
+	// No temporary file is left behind.
+	names, err := filepath.Glob(filepath.Join(filepath.Dir(name), "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Errorf("WriteFile left %q in the directory, want only %s", names, name)
+	}
+}
+
+func TestGlobScnZip(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range map[string]string{
+		"script/1_1_1.scn": "first",
+		"script/1_1_2.scn": "second",
+		"other/1_1_1.txt":  "not a script",
+	} {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "scripts.zip")
+	useMemFS(t, map[string][]byte{archive: buf.Bytes()})
+
+	for _, tc := range []struct {
+		glob string
+		want map[string]string
+	}{
+		{archive, map[string]string{"script/1_1_1.scn": "first", "script/1_1_2.scn": "second"}},
+		{archive + "!script/1_1_2.scn", map[string]string{"script/1_1_2.scn": "second"}},
+		{archive + "!*.txt", map[string]string{"other/1_1_1.txt": "not a script"}},
+	} {
+		paths, err := globScn(tc.glob)
+		if err != nil {
+			t.Fatalf("globScn(%q): %v", tc.glob, err)
+		}
+		got := make(map[string]string)
+		for _, p := range paths {
+			data, err := readScn(p)
+			if err != nil {
+				t.Fatalf("readScn(%q): %v", p, err)
+			}
+			_, entry, _ := splitZipPath(p)
+			got[entry] = string(data)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("globScn(%q) read %q, want %q", tc.glob, got, tc.want)
+		}
+	}
+}
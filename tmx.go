@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/xml"
+	"path/filepath"
+)
+
+type tmx struct {
+	XMLName xml.Name  `xml:"tmx"`
+	Version string    `xml:"version,attr"`
+	Header  tmxHeader `xml:"header"`
+	Units   []*tmxTU  `xml:"body>tu"`
+}
+
+type tmxHeader struct {
+	CreationTool        string `xml:"creationtool,attr"`
+	CreationToolVersion string `xml:"creationtoolversion,attr"`
+	SegType             string `xml:"segtype,attr"`
+	OTMF                string `xml:"o-tmf,attr"`
+	AdminLang           string `xml:"adminlang,attr"`
+	SrcLang             string `xml:"srclang,attr"`
+	DataType            string `xml:"datatype,attr"`
+}
+
+type tmxTU struct {
+	Variants []*tmxTUV `xml:"tuv"`
+}
+
+type tmxTUV struct {
+	Lang string `xml:"xml:lang,attr"`
+	Seg  string `xml:"seg"`
+}
+
+// exportTMX writes the original lines and their translations to tm.tmx as a
+// TMX 1.4 translation memory. Only the first translation of each distinct
+// original line is included.
+func exportTMX() {
+	originals := readLines(*scnFileFlag)
+
+	out := &tmx{
+		Version: "1.4",
+		Header: tmxHeader{
+			CreationTool:        "purepure",
+			CreationToolVersion: "1",
+			SegType:             "sentence",
+			OTMF:                "csv",
+			AdminLang:           "en",
+			SrcLang:             "ja",
+			DataType:            "plaintext",
+		},
+	}
+	seen := make(map[string]bool)
+	for _, l := range loadTLLines() {
+		orig, ok := originals[l.Key]
+		tl := translation(l)
+		if !ok || tl == "" {
+			continue
+		}
+		orig = removePPNewLines(orig)
+		if seen[orig] {
+			continue
+		}
+		seen[orig] = true
+		out.Units = append(out.Units, &tmxTU{Variants: []*tmxTUV{
+			{Lang: "ja", Seg: orig},
+			{Lang: "en", Seg: tl},
+		}})
+	}
+
+	data, err := xml.MarshalIndent(out, "", "  ")
+	Fatal(err)
+	data = append([]byte(xml.Header), data...)
+	Fatal(writeFile(filepath.Join(*outputFolder, "tm.tmx"), data))
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/biribiribiri/purepure/scn"
+)
+
+var validateCsv = flag.Bool("validateCsv", false, "in validate, also check the translated csv, which downloads it if it is a URL and may write -csvCache; without it validate only round-trips the SCN files, needs no network and writes nothing, e.g. for a pre-commit check of the parser")
+
+// newlineConventions returns the new line conventions used in s: real new
+// lines, and the literal "\N" and "\n" markers.
+func newlineConventions(s string) []string {
+	var found []string
+	if strings.Contains(s, "\n") {
+		found = append(found, "newline")
+	}
+	if strings.Contains(s, `\N`) {
+		found = append(found, `\N`)
+	}
+	if strings.Contains(s, `\n`) {
+		found = append(found, `\n`)
+	}
+	return found
+}
+
+// checkNewlines reports cells that mix new line conventions, which makes
+// wrapping unpredictable.
+func checkNewlines(tlLines []*TLLine) []string {
+	var problems []string
+	for _, l := range tlLines {
+		for _, cell := range []struct {
+			name, text string
+		}{{"TRANSLATED_TEXT", l.TranslatedText}, {"EDITTED_TEXT", l.EdittedText}} {
+			if found := newlineConventions(cell.text); len(found) > 1 {
+				problems = append(problems, fmt.Sprintf("%s: %s mixes new line conventions: %s", l.Key, cell.name, strings.Join(found, ", ")))
+			}
+		}
+	}
+	return problems
+}
+
+// colorReset is the color code that restores the default text color. A color
+// set with any other "\cN" code stays in effect until it is reset, including
+// across line and text box breaks, so every wrapped line should reset the
+// color it sets.
+const colorReset = `\c0`
+
+// openColorLines returns the (1-based) numbers of the lines of a patched
+// translation, as returned by transformTLLine, that end with a color other
+// than the default in effect.
+func openColorLines(parts []string) []int {
+	var open []int
+	n := 0
+	for _, part := range parts {
+		for _, line := range strings.Split(part, `\N`) {
+			n++
+			codes := colorRE.FindAllString(line, -1)
+			if len(codes) != 0 && codes[len(codes)-1] != colorReset {
+				open = append(open, n)
+			}
+		}
+	}
+	return open
+}
+
+// placeholders returns the control codes and speaker name of s that must
+// also be in its translation. The speaker name is matched by speakerRE, or
+// translatedSpeakerRE in a translation, as with -speakerColumn. New lines
+// are left out, since wrap moves them.
+func placeholders(speaker *regexp.Regexp, s string) []string {
+	var out []string
+	if name, _ := splitSpeaker(speaker, s); name != "" {
+		out = append(out, "speaker name")
+	}
+	res := []*regexp.Regexp{colorRE, voiceRE}
+	if pageBreakRE != nil {
+		res = append(res, pageBreakRE)
+	}
+	for _, re := range res {
+		for _, m := range re.FindAllString(s, -1) {
+			out = append(out, strings.TrimSpace(m))
+		}
+	}
+	return out
+}
+
+// checkPlaceholders reports translations that leave out or add control codes
+// or a speaker name of the original line, such as a voice tag, without which
+// the voice is not played. A missing voice tag at the end of the original is
+// not reported if the translation has none, since patch keeps the original's.
+func checkPlaceholders(tlLines []*TLLine, originals map[string]string) []string {
+	var problems []string
+	for _, l := range tlLines {
+		if translation(l) == "" || l.Key == "" || singleLine(l.Key) {
+			continue
+		}
+		orig, ok := originals[l.Key]
+		if !ok {
+			orig = l.OriginalText
+		}
+		tl := replaceBrackets(l.Filename, stripComments(translation(l)))
+		count := make(map[string]int)
+		var order []string
+		for _, p := range placeholders(speakerRE, orig) {
+			if count[p] == 0 {
+				order = append(order, p)
+			}
+			count[p]++
+		}
+		for _, p := range placeholders(translatedSpeakerRE, tl) {
+			if _, ok := count[p]; !ok {
+				order = append(order, p)
+			}
+			count[p]--
+		}
+		if tag := trailingVoiceRE.FindString(orig); tag != "" && !voiceRE.MatchString(tl) {
+			count[strings.TrimSpace(tag)]--
+		}
+		var missing, extra []string
+		for _, p := range order {
+			for i := 0; i < count[p]; i++ {
+				missing = append(missing, p)
+			}
+			for i := 0; i > count[p]; i-- {
+				extra = append(extra, p)
+			}
+		}
+		if len(missing) != 0 {
+			problems = append(problems, fmt.Sprintf("%s: translation is missing %s from the original", l.Key, strings.Join(missing, ", ")))
+		}
+		if len(extra) != 0 {
+			problems = append(problems, fmt.Sprintf("%s: translation adds %s, which the original does not have", l.Key, strings.Join(extra, ", ")))
+		}
+	}
+	return problems
+}
+
+// checkColors reports translations that leave a color open at the end of a
+// wrapped line, which makes the color bleed into the following text.
+func checkColors(tlLines []*TLLine) []string {
+	var problems []string
+	for _, l := range tlLines {
+		if translation(l) == "" || l.Key == "" {
+			continue
+		}
+		if open := openColorLines(transformTLLine(l)); len(open) != 0 {
+			problems = append(problems, fmt.Sprintf("%s: color is not reset at the end of wrapped line(s) %v", l.Key, open))
+		}
+	}
+	return problems
+}
+
+// checkRoundTrip reports every SCN file matching -scnFiles that does not
+// split into segments that combine back into the original file, or whose
+// choices do not match its header, and the number of files checked and
+// failed. A file can have several problems. Nothing is written to disk.
+func checkRoundTrip() (problems []string, checked, failed int) {
+	paths, err := globScn(*scnFileFlag)
+	Fatal(err)
+	p := parser()
+	for _, path := range paths {
+		data, err := readScn(path)
+		Fatal(err)
+		base := filepath.Base(path)
+		checked++
+		split, err := p.SplitFile(data)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", base, err))
+			failed++
+			continue
+		}
+		log.Printf("%s: %d segments", base, len(split))
+		if choiceProblems := checkChoiceCounts(base, data, split); len(choiceProblems) != 0 {
+			problems = append(problems, choiceProblems...)
+			failed++
+		}
+	}
+	return problems, checked, failed
+}
+
+// checkChoiceCounts reports a file whose header has a different number of
+// choice records than the file has choices or file tags, which usually means
+// the file was split wrong.
+func checkChoiceCounts(base string, data []byte, split []*scn.Segment) []string {
+	if len(data) < 4 || scn.FileSizeHeader(data) > uint32(len(data)) {
+		return []string{fmt.Sprintf("%s: file size header %v is larger than the file", base, scn.FileSizeHeader(data))}
+	}
+	fileSizeOffset := uint32(len(data)) - scn.FileSizeHeader(data)
+	if fileSizeOffset <= 12 {
+		// The header has no room for choice records.
+		return nil
+	}
+	numChoices := int(scn.NumChoices(fileSizeOffset))
+	var problems []string
+	for _, st := range []scn.SegmentType{scn.ChoiceSegment, scn.FileTagSegment} {
+		if n := countSegments(split, st); n != numChoices {
+			problems = append(problems, fmt.Sprintf("%s: header has %d choice records, but found %d %s segments", base, numChoices, n, st))
+		}
+	}
+	return problems
+}
+
+// validate round-trips the SCN files and, with -validateCsv, checks the
+// translated CSV for problems, and reports all of them. It exits with a
+// non-zero status if any problem was found.
+func validate() {
+	roundTrip, checked, failed := checkRoundTrip()
+	log.Printf("round-tripped %d files, %d failed", checked, failed)
+
+	problems := roundTrip
+	if *validateCsv {
+		tlLines := loadTLLines()
+		problems = append(problems, checkNewlines(tlLines)...)
+		problems = append(problems, checkColors(tlLines)...)
+		originals := readLines(*scnFileFlag)
+		problems = append(problems, checkPlaceholders(tlLines, originals)...)
+		if *glossaryFile != "" {
+			problems = append(problems, checkGlossary(tlLines, originals)...)
+		}
+	}
+	for _, p := range problems {
+		log.Print("WARNING: ", p)
+	}
+	log.Printf("found %d problems", len(problems))
+	if len(problems) != 0 {
+		os.Exit(1)
+	}
+}
+
+// checkChoiceOffsets reports every choice record in the header of an SCN
+// file whose destination offset does not point at a file tag.
+func checkChoiceOffsets(base string, data []byte) []string {
+	if len(data) < 4 {
+		return []string{fmt.Sprintf("%s: file is too short to have a header", base)}
+	}
+	fileSizeOffset := uint32(len(data)) - scn.FileSizeHeader(data)
+	if fileSizeOffset > uint32(len(data)) {
+		return nil
+	}
+	numChoices := scn.NumChoices(fileSizeOffset)
+
+	var problems []string
+	for i := uint32(0); i < numChoices; i++ {
+		offset := binary.LittleEndian.Uint32(data[12+(36*i)+32:])
+		pos := uint64(offset) + uint64(fileSizeOffset)
+		if pos+uint64(len(scn.FileTagStart())) > uint64(len(data)) || !bytes.Equal(data[pos:pos+uint64(len(scn.FileTagStart()))], scn.FileTagStart()) {
+			problems = append(problems, fmt.Sprintf("%s: choice %v offset %v (position %v) does not point at a file tag", base, i, offset, pos))
+			continue
+		}
+		tag := data[pos+uint64(len(scn.FileTagStart())):]
+		if end := bytes.IndexByte(tag, lineTerminator()); end != -1 {
+			tag = tag[:end]
+		}
+		logV("%s: choice %v offset %v points at file tag %q", base, i, offset, scn.Decode(tag))
+	}
+	return problems
+}
+
+// choiceOffsets verifies the choice destination offsets stored in the header
+// of every SCN file.
+func choiceOffsets() {
+	paths, err := globScn(*scnFileFlag)
+	Fatal(err)
+	var problems []string
+	for _, path := range paths {
+		data, err := readScn(path)
+		Fatal(err)
+		problems = append(problems, checkChoiceOffsets(filepath.Base(path), data)...)
+	}
+	for _, p := range problems {
+		log.Print("WARNING: ", p)
+	}
+	log.Printf("found %d problems", len(problems))
+}
+
+// roundTrip extracts the lines of every SCN file matching -scnFiles and
+// patches their original text back in unchanged, and reports the files that
+// do not come out identical. Speech bubbles and the FOTS fixes are left
+// alone, since those changes are intended. It exits with a non-zero status if
+// any problem was found.
+func roundTrip() {
+	paths, err := globScn(*scnFileFlag)
+	Fatal(err)
+	problems := roundTripProblems(paths)
+	for _, p := range problems {
+		log.Print("WARNING: ", p)
+	}
+	log.Printf("round-tripped %d files, found %d problems", len(paths), len(problems))
+	if len(problems) != 0 {
+		os.Exit(1)
+	}
+}
+
+// roundTripProblems returns the problems roundTrip finds in the SCN files at
+// paths.
+func roundTripProblems(paths []string) []string {
+	var problems []string
+	patcher := &scn.Patcher{
+		Parser:           scn.Parser{Terminator: lineTerminator()},
+		AllowLossyParse:  *allowLossyParse,
+		StrictSize:       strictSizeMode,
+		RouteChangeFiles: splitList(*routeChangeFlag),
+		KeepBubbles:      func(string) bool { return true },
+		SkipFOTSPatches:  true,
+		Warn: func(w *scn.Warning) {
+			problems = append(problems, w.String())
+		},
+		Debugf: logV,
+	}
+	for _, path := range paths {
+		data, err := readScn(path)
+		Fatal(err)
+		base := filepath.Base(path)
+		split, err := splitFile(base, data)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", base, err))
+			continue
+		}
+
+		// The original text of each line is patched back in as its
+		// translation, through the transforms patch makes. Lines sharing a key
+		// are joined with the split marker, as a translator would.
+		var keys []string
+		lines := make(map[string]*TLLine)
+		for _, l := range fileTLLines(base, split, nil) {
+			// -speakerColumn moves the speaker out of the original text.
+			text := l.Speaker + l.OriginalText
+			if prev, ok := lines[l.Key]; ok {
+				prev.TranslatedText = joinSplitLines(prev.TranslatedText, text)
+				continue
+			}
+			keys = append(keys, l.Key)
+			lines[l.Key] = &TLLine{Filename: base, Key: l.Key, Index: l.Index, TranslatedText: text}
+		}
+		patcher.Lines = make(map[string][]byte)
+		for _, key := range keys {
+			l := lines[key]
+			if strings.TrimSpace(stripComments(translation(l))) == "" {
+				continue
+			}
+			jis, err := encodeTLLine(l)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: original text %q: %v", l.Key, l.TranslatedText, err))
+				continue
+			}
+			patcher.Lines[l.Key] = jis
+		}
+
+		res, err := patcher.Patch(base, data)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", base, err))
+			continue
+		}
+		if !bytes.Equal(res.Data, data) {
+			offset := 0
+			for offset < len(data) && offset < len(res.Data) && data[offset] == res.Data[offset] {
+				offset++
+			}
+			problems = append(problems, fmt.Sprintf("%s: patched file differs from the original at offset %d (%#x)", base, offset, offset))
+			continue
+		}
+		logV("%s: round-tripped %d segments", base, len(split))
+	}
+	return problems
+}
+
+// checkEncoding reports the segments of an SCN file whose bytes do not
+// survive being decoded and encoded again with -encoding. These lines would
+// be extracted as empty or mangled text.
+func checkEncoding(base string, split []*scn.Segment) []string {
+	var problems []string
+	offset := 0
+	for _, ss := range split {
+		if ss.Type != "" && len(ss.Data) != 0 {
+			reason := ""
+			text := scn.Decode(ss.Data)
+			if text == "" {
+				reason = "cannot be decoded"
+			} else if enc, err := scn.Encode(text); err != nil {
+				reason = fmt.Sprintf("decodes to %q, which cannot be encoded again: %v", text, err)
+			} else if !bytes.Equal(enc, ss.Data) {
+				reason = fmt.Sprintf("decodes to %q, which encodes to different bytes", text)
+			}
+			if reason != "" {
+				problems = append(problems, fmt.Sprintf("%s at offset %d (%#x) %s:\n%s", scn.Key(base, ss.Type, ss.Index), offset, offset, reason, hex.Dump(ss.Data)))
+			}
+		}
+		offset += len(ss.Data)
+	}
+	return problems
+}
+
+// verifyEncoding reports every segment of the SCN files matching -scnFiles
+// that does not round-trip through -encoding.
+func verifyEncoding() {
+	paths, err := globScn(*scnFileFlag)
+	Fatal(err)
+	var problems []string
+	for _, path := range paths {
+		data, err := readScn(path)
+		Fatal(err)
+		base := filepath.Base(path)
+		split, err := splitFile(base, data)
+		if err != nil {
+			log.Printf("WARNING: skipping %s: %v", base, err)
+			continue
+		}
+		problems = append(problems, checkEncoding(base, split)...)
+	}
+	for _, p := range problems {
+		log.Print("WARNING: ", p)
+	}
+	log.Printf("found %d problems", len(problems))
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckPlaceholders(t *testing.T) {
+	setFlags(t, nil)
+	const key = "1_1_1.scn-text-0"
+	for _, tc := range []struct {
+		name, orig, tl string
+		want           []string
+	}{
+		{"nothing to keep", "こんにちは", "Hello", nil},
+		{"speaker kept", "「太郎」こんにちは", "「Taro」Hello", nil},
+		{"speaker in square brackets", "「太郎」こんにちは", "[Taro] Hello", nil},
+		{"speaker in the sheet's brackets", "【太郎】こんにちは", "【Taro】Hello", nil},
+		{"speaker missing", "「太郎」こんにちは", "Hello", []string{key + ": translation is missing speaker name from the original"}},
+		{"speaker added", "こんにちは", "「Taro」Hello", []string{key + ": translation adds speaker name, which the original does not have"}},
+		// A line that is only a quote, or a sentence in brackets, has no
+		// speaker.
+		{"quote", "「こんにちは」", "'Hello'", nil},
+		{"bracketed sentence", "「こんにちは。元気？」と言った", "Said hello", nil},
+		{"color missing", `\c12こんにちは\c0`, "Hello", []string{key + `: translation is missing \c12, \c0 from the original`}},
+		{"trailing voice tag kept by patch", `こんにちは\V"v001"`, "Hello", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := &TLLine{Filename: "1_1_1.scn", Key: key, TranslatedText: tc.tl}
+			if got := checkPlaceholders([]*TLLine{l}, map[string]string{key: tc.orig}); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("checkPlaceholders(%q, %q) = %q, want %q", tc.orig, tc.tl, got, tc.want)
+			}
+		})
+	}
+}